@@ -1,33 +1,72 @@
 package broker
 
 import (
+	"crypto/md5"
 	"encoding/json"
 	"github.com/garyburd/redigo/redis"
+	"github.com/siddontang/go-log/log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type App struct {
-	cfg *Config
+	//*Config, replaced as a whole when reloading, never changed in place
+	cfg atomic.Value
+
+	//empty if app is not created from config file
+	configFile string
+	reloadLock sync.Mutex
 
 	listener net.Listener
 
 	httpListener net.Listener
 
+	httpServer *http.Server
+
 	redis *redis.Pool
 
 	ms Store
 
 	qs *queues
 
+	flow *flow
+
+	metrics *metrics
+
+	//tracerHolder, see trace.go
+	tracer atomic.Value
+
+	connLock sync.Mutex
+	connId   int64
+	conns    map[int64]*conn
+	connWg   sync.WaitGroup
+
+	//closed when shutdown starts
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	//closed when app closes
+	closed    chan struct{}
+	closeOnce sync.Once
+
 	passMD5 []byte
 }
 
 func NewAppWithConfig(cfg *Config) (*App, error) {
 	app := new(App)
 
-	app.cfg = cfg
+	app.cfg.Store(cfg)
+
+	applyLogLevel(cfg)
+
+	if len(cfg.AdminPassword) > 0 {
+		sum := md5.Sum([]byte(cfg.AdminPassword))
+		app.passMD5 = sum[:]
+	}
 
 	var err error
 
@@ -45,11 +84,25 @@ func NewAppWithConfig(cfg *Config) (*App, error) {
 
 	app.qs = newQueues(app)
 
-	app.ms, err = OpenStore(cfg.Store, cfg.StoreConfig)
+	app.conns = make(map[int64]*conn)
+
+	app.quit = make(chan struct{})
+	app.closed = make(chan struct{})
+
+	app.metrics = newMetrics()
+
+	var s Store
+	s, err = OpenStore(cfg.Store, cfg.StoreConfig)
 	if err != nil {
 		return nil, err
 	}
 
+	app.ms = newMeteredStore(s, app.metrics)
+
+	app.flow = newFlow(app)
+
+	app.httpServer = app.newHttpServer()
+
 	return app, nil
 }
 
@@ -71,46 +124,189 @@ func NewApp(jsonConfig json.RawMessage) (*App, error) {
 	return NewAppWithConfig(cfg)
 }
 
+//NewAppWithConfigFile creates app which can reload config file later
+func NewAppWithConfigFile(configFile string) (*App, error) {
+	cfg, err := parseConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	app.configFile = configFile
+
+	return app, nil
+}
+
+//Addr returns tcp listening address, useful if listening on port 0
+func (app *App) Addr() string {
+	return app.listener.Addr().String()
+}
+
+//HttpAddr returns http listening address, empty if http is disabled
+func (app *App) HttpAddr() string {
+	if app.httpListener == nil {
+		return ""
+	}
+
+	return app.httpListener.Addr().String()
+}
+
+//Config returns current config, it must not be changed
 func (app *App) Config() *Config {
-	return app.cfg
+	return app.cfg.Load().(*Config)
 }
 
+//Close closes app immediately, msgs not acked are pushed again after
+//restart, use Shutdown to close gracefully
 func (app *App) Close() {
-	if app.listener != nil {
-		app.listener.Close()
-	}
+	app.startShutdown()
 
-	if app.httpListener != nil {
-		app.httpListener.Close()
-	}
+	app.closeOnce.Do(func() {
+		close(app.closed)
+
+		if app.httpServer != nil {
+			app.httpServer.Close()
+		}
+
+		//server closes listener only if Run has served it
+		if app.httpListener != nil {
+			app.httpListener.Close()
+		}
+
+		app.flow.Close()
+
+		//conn unbinds all channels when exits
+		for _, c := range app.listConns() {
+			c.c.Close()
+		}
+		app.connWg.Wait()
+
+		app.qs.Close()
 
-	app.ms.Close()
+		app.ms.Close()
+	})
 }
 
-func (app *App) startHttp() {
+func (app *App) newHttpServer() *http.Server {
 	if app.httpListener == nil {
-		return
+		return nil
 	}
 
+	mux := http.NewServeMux()
+
+	h := newMsgHandler(app)
+	mux.Handle("/msg", app.rejectClosing(h.ServeHTTP))
+	mux.HandleFunc("/msg/ack", h.ackMsg)
+	mux.HandleFunc("/msg/nack", h.nackMsg)
+	mux.Handle("/msg/batch", app.rejectClosing(h.batchMsg))
+	mux.Handle("/msg/sse", app.rejectClosing(h.sseMsg))
+	mux.Handle("/msg/ws", app.rejectClosing(h.wsMsg))
+
+	a := newAdminHandler(app)
+	a.register(mux)
+
+	mux.HandleFunc("/metrics", app.serveMetrics)
+
 	s := new(http.Server)
+	s.Handler = mux
 
-	http.Handle("/msg", newMsgHandler(app))
+	return s
+}
+
+//publish and consume requests are rejected after shutdown starts,
+//ack and nack are still served for msgs pushed before
+func (app *App) rejectClosing(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.isClosing() {
+			http.Error(w, "broker is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+func (app *App) startHttp() {
+	if app.httpServer == nil {
+		return
+	}
 
-	s.Serve(app.httpListener)
+	app.httpServer.Serve(app.httpListener)
 }
 
 func (app *App) startTcp() {
 	for {
 		conn, err := app.listener.Accept()
 		if err != nil {
+			if app.isClosing() {
+				return
+			}
+
+			log.Infof("accept error %v", err)
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 
 		co := newConn(app, conn)
+		if !app.addConn(co) {
+			conn.Close()
+			return
+		}
+
 		go co.run()
 	}
 }
 
+//returns false if app is closed
+func (app *App) addConn(c *conn) bool {
+	app.connLock.Lock()
+	defer app.connLock.Unlock()
+
+	if app.isClosing() {
+		return false
+	}
+
+	app.connId++
+	c.id = app.connId
+	app.conns[c.id] = c
+	app.connWg.Add(1)
+
+	app.metrics.conns.Inc()
+
+	return true
+}
+
+func (app *App) removeConn(c *conn) {
+	app.connLock.Lock()
+	delete(app.conns, c.id)
+	app.connLock.Unlock()
+
+	app.connWg.Done()
+}
+
+func (app *App) getConn(id int64) *conn {
+	app.connLock.Lock()
+	c := app.conns[id]
+	app.connLock.Unlock()
+
+	return c
+}
+
+func (app *App) listConns() []*conn {
+	app.connLock.Lock()
+	cs := make([]*conn, 0, len(app.conns))
+	for _, c := range app.conns {
+		cs = append(cs, c)
+	}
+	app.connLock.Unlock()
+
+	return cs
+}
+
 func (app *App) Run() {
 	go app.startHttp()
 
@@ -1,34 +1,38 @@
 package broker
 
 import (
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/client"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 var testOnce sync.Once
 var testApp *App
 
+//listen on ephemeral ports, tests get them with testAddr and testHttpUrl
 var testConfig = `
     {
         "version":1,
-        "addr": "127.0.0.1:11181",
+        "addr": "127.0.0.1:0",
 
-        "http_addr": "127.0.0.1:11180",
+        "http_addr": "127.0.0.1:0",
 
         "keepalive":60,
 
-        "max_msg_size":1024,
+        "max_msg_size":65536,
         "msg_timeout":10,
         "max_queue_size":1024,
 
-        "store":"redis",
-        "store_config": {
-            "addr":"127.0.0.1:6379",
-            "db":0,
-            "password":"",
-            "idle_conns":16,
-            "key_prefix":"test_moonmq"
-        }
+        "admin_password":"admin",
+
+        "store":"mem"
     }
 `
 
@@ -48,6 +52,206 @@ func getTestApp() *App {
 	return testApp
 }
 
+func testAddr() string {
+	return getTestApp().Addr()
+}
+
+func testHttpUrl(path string) string {
+	return fmt.Sprintf("http://%s%s", getTestApp().HttpAddr(), path)
+}
+
+func testAdminRequest(method string, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, testHttpUrl(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth("admin", "admin")
+	return http.DefaultClient.Do(req)
+}
+
 func TestApp(t *testing.T) {
 	getTestApp()
 }
+
+func TestShutdown(t *testing.T) {
+	app, err := NewApp([]byte(`
+    {
+        "version":1,
+        "addr": "127.0.0.1:0",
+        "http_addr": "127.0.0.1:0",
+        "keepalive":60,
+        "store":"mem"
+    }
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runDone := make(chan struct{})
+	go func() {
+		app.Run()
+		close(runDone)
+	}()
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, app.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := c.Bind("test_queue_shutdown", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Publish("test_queue_shutdown", "", []byte("123"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := ch.GetMsg(); string(msg) != "123" {
+		t.Fatal(string(msg))
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		shutdownDone <- app.Shutdown(ctx)
+		cancel()
+	}()
+
+	//wait msg acked
+	select {
+	case err = <-shutdownDone:
+		t.Fatal("shutdown before ack", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if _, err = c.Publish("test_queue_shutdown", "", []byte("456"), "direct"); err == nil {
+		t.Fatal("publish must fail when shutting down")
+	}
+
+	if err = ch.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-shutdownDone; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-runDone:
+	case <-time.After(time.Second):
+		t.Fatal("run not exit")
+	}
+}
+
+func TestCloseWithoutRun(t *testing.T) {
+	app, err := NewApp([]byte(`
+    {
+        "addr": "127.0.0.1:0",
+        "http_addr": "127.0.0.1:0",
+        "store":"mem"
+    }
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, httpAddr := app.Addr(), app.HttpAddr()
+	app.Close()
+
+	//listeners are closed, so addresses can be listened again
+	for _, a := range []string{addr, httpAddr} {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+}
+
+func TestReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "moonmq_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	config := `
+    {
+        "version":1,
+        "addr": "%s",
+        "keepalive":%d,
+        "store":"mem"
+    }
+    `
+
+	if err = ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(config, "127.0.0.1:0", 60)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := NewAppWithConfigFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	if err = ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(config, "127.0.0.1:1", 30)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := app.ReloadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Applied) != 1 || r.Applied[0] != "keepalive" {
+		t.Fatal(r.Applied)
+	} else if len(r.RestartRequired) != 1 || r.RestartRequired[0] != "addr" {
+		t.Fatal(r.RestartRequired)
+	}
+
+	if cfg := app.Config(); cfg.KeepAlive != 30 || cfg.Addr != "127.0.0.1:0" {
+		t.Fatal(cfg.KeepAlive, cfg.Addr)
+	}
+}
+
+func TestConfigKeepAlive(t *testing.T) {
+	cfg, err := parseConfigJson([]byte(`{"addr":"127.0.0.1:0", "store":"mem"}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if cfg.KeepAlive != defaultKeepAlive {
+		t.Fatal(cfg.KeepAlive)
+	}
+
+	if _, err = parseConfigJson([]byte(`{"keepalive":601}`)); err == nil {
+		t.Fatal("must error")
+	}
+
+	cfg = NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = ""
+	cfg.KeepAlive = 0
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	if d := app.Config().keepAliveDuration(); d != defaultKeepAlive*time.Second {
+		t.Fatal(d)
+	}
+
+	reload := *cfg
+	if _, err = app.Reload(&reload); err == nil {
+		t.Fatal("reload with zero keepalive must error")
+	}
+}
@@ -1,25 +1,37 @@
 package broker
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/proto"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
-var testClientConfig = []byte(`
+var testClientConfigFormat = `
     {
-        "broker_addr":"127.0.0.1:11181",
+        "broker_addr":"%s",
         "keepavlie":60,
-        "idle_conns":16
+        "idle_conns":16,
+        "compression":"snappy,gzip",
+        "compress_threshold":8
     }
-    `)
+    `
 
-var testUrlMsg = "http://127.0.0.1:11180/msg"
+func testClientConfig() []byte {
+	return []byte(fmt.Sprintf(testClientConfigFormat, testAddr()))
+}
 
 var testClient *client.Client
 var testClientOnce sync.Once
@@ -27,7 +39,7 @@ var testClientOnce sync.Once
 func getTestClient() *client.Client {
 	f := func() {
 		var err error
-		testClient, err = client.NewClient(testClientConfig)
+		testClient, err = client.NewClient(testClientConfig())
 		if err != nil {
 			println("------------", err.Error())
 			panic(err)
@@ -79,6 +91,67 @@ func TestPush(t *testing.T) {
 	}
 }
 
+func TestPushCompress(t *testing.T) {
+	body := bytes.Repeat([]byte("hello world"), 100)
+	if err := testPublish("test_queue_compress", "", body, "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := getClientConn()
+	defer c.Close()
+
+	ch, err := c.Bind("test_queue_compress", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := ch.GetMsg(); !bytes.Equal(msg, body) {
+		t.Fatal(string(msg))
+	}
+}
+
+func TestPushTooLarge(t *testing.T) {
+	plain, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, testAddr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	queue := "test_queue_too_large"
+	max := getTestApp().Config().MaxMessageSize
+
+	//same limit whether client compresses body or not, compressed one is
+	//tiny on the wire, but rejected after decompressing max_msg_size
+	for _, cli := range []*client.Client{plain, getTestClient()} {
+		c, err := cli.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Publish(queue, "", make([]byte, max+1), "direct")
+		if e, ok := err.(*client.ReplyError); !ok || e.Code != "413" {
+			t.Fatal(err)
+		}
+
+		//conn goes on working
+		if _, err = c.Publish(queue, "", make([]byte, max), "direct"); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+	}
+
+	resp, err := http.Post(testHttpUrl("/msg?pub_type=direct&queue="+queue),
+		"application/octet-stream", bytes.NewReader(make([]byte, max+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal(resp.StatusCode)
+	}
+}
+
 func TestPubDirect(t *testing.T) {
 	c1 := getClientConn()
 	c2 := getClientConn()
@@ -172,6 +245,101 @@ func TestPubFanout(t *testing.T) {
 	}
 }
 
+//recordPusher never acks, queue acks msgs pushed to no ack channel itself
+type recordPusher struct {
+	ms chan *msg
+}
+
+func (p *recordPusher) Push(ch *channel, m *msg) error {
+	p.ms <- m
+	return nil
+}
+
+func TestPushNoAck(t *testing.T) {
+	app := getTestApp()
+
+	queue := "test_queue_noack_push"
+	p := &recordPusher{make(chan *msg, 3)}
+	ch := newChannel(p, app.qs.Get(queue), "", true)
+	defer ch.Close()
+
+	for _, body := range []string{"1", "2", "3"} {
+		if err := testPublish(queue, "", []byte(body), "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, body := range []string{"1", "2", "3"} {
+		select {
+		case m := <-p.ms:
+			if string(m.body) != body {
+				t.Fatal(string(m.body), body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("wait push timeout", body)
+		}
+	}
+
+	if ch.q.Inflight() {
+		t.Fatal("no ack msg must not wait ack")
+	} else if n, err := app.ms.Len(queue); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestPushNoAckFlood(t *testing.T) {
+	//consumer buffers only one msg, then blocks reading conn
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s", "max_queue_size":1}`, testAddr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	queue := "test_queue_noack_flood"
+
+	ch, err := c.Bind(queue, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//more publishers than queue func buffer, and consumer doesn't read at
+	//first, so push blocks until buffer is full, no ack push done then must
+	//not wait queue goroutine to ack it
+	publishers := 64
+	n := 20
+	body := make([]byte, 16*1024)
+
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if err := testPublish(queue, "", body, "direct"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < publishers*n; i++ {
+		if msg := ch.WaitMsg(5 * time.Second); msg == nil {
+			t.Fatal("wait msg timeout", i)
+		}
+	}
+
+	wg.Wait()
+}
+
 func TestUnbind(t *testing.T) {
 	c := getClientConn()
 	defer c.Close()
@@ -226,8 +394,154 @@ func TestAck(t *testing.T) {
 	}
 }
 
+func TestGet(t *testing.T) {
+	c := getClientConn()
+	defer c.Close()
+
+	queue := "test_queue_get"
+
+	if m, err := c.Get(queue, 0); err != nil {
+		t.Fatal(err)
+	} else if m != nil {
+		t.Fatal("must empty")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := testPublish(queue, "", []byte(fmt.Sprintf("%d", i)), "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ms, err := c.GetMsgs(queue, "", 2, time.Second, true); err != nil {
+		t.Fatal(err)
+	} else if len(ms) != 2 {
+		t.Fatal(len(ms))
+	} else if string(ms[0].Body) != "0" || string(ms[1].Body) != "1" {
+		t.Fatal(string(ms[0].Body), string(ms[1].Body))
+	}
+
+	ms, err := c.GetMsgs(queue, "", 1, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ms) != 1 || string(ms[0].Body) != "2" {
+		t.Fatal("invalid get msg")
+	}
+
+	if err := c.Ack(queue, ms[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		testPublish(queue, "", []byte("3"), "direct")
+	}()
+
+	if m, err := c.Get(queue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	} else if m == nil || string(m.Body) != "3" {
+		t.Fatal("invalid get msg")
+	}
+}
+
+func TestGetLeaseAck(t *testing.T) {
+	app := getTestApp()
+
+	c := getClientConn()
+	defer c.Close()
+
+	queue := "test_queue_get_lease_ack"
+
+	ds := make(chan *client.Delivery, 1)
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		ds <- d
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	if err = testPublish(queue, "", []byte("1"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	var d *client.Delivery
+	select {
+	case d = <-ds:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait delivery timeout")
+	}
+
+	//get waits in lease while channel msg waits ack
+	got := make(chan *client.Message, 1)
+	go func() {
+		ms, err := c.GetMsgs(queue, "", 1, 2*time.Second, false)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(ms) == 0 {
+			got <- nil
+		} else {
+			got <- ms[0]
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	//nack of channel msg is not taken by lease
+	if err = d.Nack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		if n, _ := app.QueueLen(queue); n == 0 {
+			break
+		} else if i == 100 {
+			t.Fatal("channel msg not nacked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//lease still waits, round robin pushes to consumer then to it
+	for _, body := range []string{"2", "3"} {
+		if err = testPublish(queue, "", []byte(body), "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case d = <-ds:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait delivery timeout")
+	}
+
+	if string(d.Body) != "2" {
+		t.Fatal(string(d.Body))
+	} else if err = d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-got
+	if m == nil || string(m.Body) != "3" {
+		t.Fatal("lease lost", m)
+	} else if err = c.Ack(queue, m.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		if n, _ := app.QueueLen(queue); n == 0 {
+			break
+		} else if i == 100 {
+			t.Fatal("leased msg not acked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func testHttpPublish(queue string, routingKey string, body []byte, pubType string) error {
-	url := fmt.Sprintf("%s?queue=%s&routing_key=%s&pub_type=%s", testUrlMsg, queue, routingKey, pubType)
+	getTestApp()
+
+	url := fmt.Sprintf("%s?queue=%s&routing_key=%s&pub_type=%s", testHttpUrl("/msg"), queue, routingKey, pubType)
 	resp, err := http.Post(url, "text/plain", bytes.NewReader(body))
 	if err != nil {
 		return err
@@ -242,7 +556,7 @@ func testHttpPublish(queue string, routingKey string, body []byte, pubType strin
 }
 
 func testHttpConsume(queue string, routingKey string) ([]byte, error) {
-	url := fmt.Sprintf("%s?queue=%s&routing_key=%s", testUrlMsg, queue, routingKey)
+	url := fmt.Sprintf("%s?queue=%s&routing_key=%s", testHttpUrl("/msg"), queue, routingKey)
 
 	resp, err := http.Get(url)
 	if err != nil {
@@ -274,3 +588,989 @@ func TestHttp(t *testing.T) {
 		t.Fatal(string(body))
 	}
 }
+
+func testHttpLease(queue string) (string, []byte, error) {
+	url := fmt.Sprintf("%s?queue=%s&ack=1", testHttpUrl("/msg"), queue)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("consume error %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.Header.Get("X-Moonmq-Msg-Id"), body, err
+}
+
+func testHttpAck(method string, queue string, msgId string) error {
+	url := fmt.Sprintf("%s/%s?queue=%s&msg_id=%s", testHttpUrl("/msg"), method, queue, msgId)
+
+	resp, err := http.Post(url, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s error %s", method, resp.Status)
+	}
+
+	return nil
+}
+
+func TestHttpAck(t *testing.T) {
+	queue := "test_queue_http_ack"
+	if err := testHttpPublish(queue, "", []byte("hello world"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, body, err := testHttpLease(queue)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(body) != "hello world" {
+		t.Fatal(string(body))
+	}
+
+	if err := testHttpAck("nack", queue, id); err != nil {
+		t.Fatal(err)
+	}
+
+	id2, body, err := testHttpLease(queue)
+	if err != nil {
+		t.Fatal(err)
+	} else if id2 != id || string(body) != "hello world" {
+		t.Fatal(id2, string(body))
+	}
+
+	if err := testHttpAck("ack", queue, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testHttpAck("ack", queue, id); err == nil {
+		t.Fatal("must error")
+	}
+}
+
+func TestHttpBatch(t *testing.T) {
+	getTestApp()
+
+	queue := "test_queue_http_batch"
+	body := `{"body":"0", "headers":{"a":"b"}}
+{"body":"MQ==", "base64":true}
+{"body":"2", "pub_type":"fanout"}`
+
+	url := fmt.Sprintf("%s/batch?queue=%s&pub_type=direct", testHttpUrl("/msg"), queue)
+	resp, err := http.Post(url, "application/x-ndjson", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r struct {
+		Ids  []int64 `json:"ids"`
+		Msgs []struct {
+			Id      int64             `json:"id"`
+			Headers map[string]string `json:"headers"`
+			Body    string            `json:"body"`
+		} `json:"msgs"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.Ids) != 3 {
+		t.Fatal(r.Ids)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/batch?queue=%s&count=10&timeout=1000", testHttpUrl("/msg"), queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.Msgs) != 3 {
+		t.Fatal(len(r.Msgs))
+	}
+
+	for i, m := range r.Msgs {
+		if m.Id != r.Ids[i] || m.Body != fmt.Sprintf("%d", i) {
+			t.Fatal(m.Id, m.Body)
+		}
+	}
+
+	if r.Msgs[0].Headers["a"] != "b" {
+		t.Fatal(r.Msgs[0].Headers)
+	}
+}
+
+func TestHttpSSE(t *testing.T) {
+	getTestApp()
+
+	queue := "test_queue_http_sse"
+	resp, err := http.Get(fmt.Sprintf("%s/sse?queue=%s", testHttpUrl("/msg"), queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := testHttpPublish(queue, "", []byte("hello world"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			if !strings.Contains(line, `"body":"hello world"`) {
+				t.Fatal(line)
+			}
+			return
+		}
+	}
+}
+
+func TestHttpWebSocket(t *testing.T) {
+	getTestApp()
+
+	queue := "test_queue_http_ws"
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/msg/ws", getTestApp().HttpAddr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var reply struct {
+		Action string `json:"action"`
+		Msg    struct {
+			Id   int64  `json:"id"`
+			Body string `json:"body"`
+		} `json:"msg"`
+	}
+
+	if err = ws.WriteJSON(map[string]interface{}{"action": "bind", "queue": queue}); err != nil {
+		t.Fatal(err)
+	} else if err = ws.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	} else if reply.Action != "bind_ok" {
+		t.Fatal(reply.Action)
+	}
+
+	if err := testHttpPublish(queue, "", []byte("hello world"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ws.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	} else if reply.Action != "push" || reply.Msg.Body != "hello world" {
+		t.Fatal(reply.Action, reply.Msg.Body)
+	}
+
+	if err = ws.WriteJSON(map[string]interface{}{"action": "ack", "queue": queue, "msg_id": reply.Msg.Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ws.WriteJSON(map[string]interface{}{"action": "unbind", "queue": queue}); err != nil {
+		t.Fatal(err)
+	} else if err = ws.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	} else if reply.Action != "unbind_ok" {
+		t.Fatal(reply.Action)
+	}
+}
+
+func TestHttpAdmin(t *testing.T) {
+	getTestApp()
+
+	queue := "test_queue_http_admin"
+
+	if resp, err := http.Get(testHttpUrl("/admin/queues")); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal(resp.StatusCode)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := testHttpPublish(queue, "", []byte(fmt.Sprintf("%d", i)), "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var info struct {
+		Name  string `json:"name"`
+		Depth int    `json:"depth"`
+	}
+
+	resp, err := testAdminRequest("GET", "/admin/queue?name="+queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Name != queue || info.Depth != 3 {
+		t.Fatal(info)
+	}
+
+	var peek struct {
+		Msgs []struct {
+			Body string `json:"body"`
+		} `json:"msgs"`
+	}
+
+	resp, err = testAdminRequest("GET", fmt.Sprintf("/admin/queue/peek?name=%s&count=2", queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&peek)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(peek.Msgs) != 2 || peek.Msgs[0].Body != "0" || peek.Msgs[1].Body != "1" {
+		t.Fatal(peek.Msgs)
+	}
+
+	c := getClientConn()
+	if _, err = c.Bind(queue, "bind_key", false); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns struct {
+		Conns []struct {
+			Id       int64 `json:"id"`
+			Channels []struct {
+				Queue string `json:"queue"`
+			} `json:"channels"`
+		} `json:"conns"`
+	}
+
+	resp, err = testAdminRequest("GET", "/admin/conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var connId int64
+	for _, co := range conns.Conns {
+		for _, ch := range co.Channels {
+			if ch.Queue == queue {
+				connId = co.Id
+			}
+		}
+	}
+
+	if connId == 0 {
+		t.Fatal("bound conn not found")
+	}
+
+	doRequest := func(method string, path string) int {
+		resp, err := testAdminRequest(method, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := doRequest("DELETE", "/admin/queue?name="+queue); code != http.StatusConflict {
+		t.Fatal(code)
+	}
+
+	if code := doRequest("DELETE", fmt.Sprintf("/admin/conn?id=%d", connId)); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	c.Close()
+
+	if code := doRequest("POST", "/admin/queue/purge?name="+queue); code != http.StatusOK {
+		t.Fatal(code)
+	}
+
+	//wait conn closed and channel unbound
+	for i := 0; i < 10; i++ {
+		if code := doRequest("DELETE", "/admin/queue?name="+queue); code == http.StatusOK {
+			break
+		} else if i == 9 {
+			t.Fatal(code)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if code := doRequest("GET", "/admin/queue?name="+queue); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+}
+
+func TestQueueDeleted(t *testing.T) {
+	app := getTestApp()
+
+	name := "test_queue_deleted"
+	rq := app.qs.Get(name)
+	if err := rq.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if _, err := rq.Info(); err != errQueueDeleted {
+			t.Error(err)
+		}
+		if err := rq.Purge(); err != errQueueDeleted {
+			t.Error(err)
+		}
+		if err := rq.Delete(); err != errQueueDeleted {
+			t.Error(err)
+		}
+		if rq.Inflight() {
+			t.Error("deleted queue must not be inflight")
+		}
+		rq.Sync()
+		rq.Push(nil)
+
+		//binding a deleted queue binds a new one
+		ch := newChannel(newGetMsgPusher(), rq, "", true)
+		if ch.q == rq || app.qs.Getx(name) != ch.q {
+			t.Error("channel not bound to new queue")
+		}
+		ch.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("deleted queue blocks requests")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	if err := testHttpPublish("test_queue_metrics", "", []byte("123"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(testHttpUrl("/metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := string(buf)
+	for _, v := range []string{
+		"moonmq_publishes_total ",
+		`moonmq_queue_depth{queue="test_queue_metrics"} `,
+		`moonmq_store_duration_seconds_count{method="save"} `,
+	} {
+		if !strings.Contains(s, v) {
+			t.Fatal(v, s)
+		}
+	}
+
+	if strings.Contains(s, "moonmq_publishes_total 0\n") {
+		t.Fatal(s)
+	}
+}
+
+func TestMultiBrokerShutdown(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = ""
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go app.Run()
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addrs":["%s", "%s"], "idle_conns":2}`, app.Addr(), testAddr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	queue := "test_queue_multi_broker_shutdown"
+
+	if _, err = cli.Publish(queue, "", []byte("1"), "direct"); err != nil {
+		t.Fatal(err)
+	} else if n, _ := app.QueueLen(queue); n != 1 {
+		t.Fatal(n)
+	}
+
+	//two idle conns to the first broker are pooled, retry skips both
+	c1, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c2.Close()
+
+	//shutting down broker replies 503, publish goes to the other one
+	app.startShutdown()
+
+	other, _ := getTestApp().QueueLen(queue)
+
+	if _, err = cli.Publish(queue, "", []byte("2"), "direct"); err != nil {
+		t.Fatal(err)
+	} else if n, _ := app.QueueLen(queue); n != 1 {
+		t.Fatal(n)
+	}
+
+	for _, h := range cli.Brokers() {
+		if h.Addr == app.Addr() && h.Healthy {
+			t.Fatal("shutting down broker not marked failed")
+		}
+	}
+
+	if n, _ := getTestApp().QueueLen(queue); n != other+1 {
+		t.Fatal(n, other)
+	}
+}
+
+func TestFlow(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = "127.0.0.1:0"
+	cfg.FlowQueueHigh = 2
+	cfg.FlowQueueLow = 1
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go app.Run()
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, app.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	queue := "test_queue_flow"
+
+	publish := func(body string) chan error {
+		r := make(chan error, 1)
+		go func() {
+			_, err := c.Publish(queue, "", []byte(body), "direct")
+			r <- err
+		}()
+		return r
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if err = <-publish(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//queue reaches flow_queue_high, publish is paused before saving msg
+	r := publish("3")
+	select {
+	case err = <-r:
+		t.Fatal("publish not paused", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if n, err := app.ms.Len(queue); err != nil || n != 2 {
+		t.Fatal("paused msg saved", n, err)
+	}
+
+	//paused conn is still read, so acks of its own consumer resume flow
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		return nil
+	}, &client.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-r:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish not resumed")
+	}
+
+	if err = cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//http publisher
+	httpQueue := "test_queue_flow_http"
+	url := fmt.Sprintf("http://%s/msg?queue=%s&pub_type=direct", app.HttpAddr(), httpQueue)
+	httpPublish := func(ctx context.Context) error {
+		req, _ := http.NewRequest("POST", url, strings.NewReader("123"))
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("publish error %s", resp.Status)
+		}
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = httpPublish(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//paused publisher can give up, msg is not saved
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	err = httpPublish(ctx)
+	cancel()
+	if err == nil {
+		t.Fatal("publish not paused")
+	} else if n, err := app.ms.Len(httpQueue); err != nil || n != 2 {
+		t.Fatal("paused msg saved", n, err)
+	}
+
+	r = make(chan error, 1)
+	go func() {
+		r <- httpPublish(context.Background())
+	}()
+
+	//2 msgs saved, resume after 1 consumed
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+
+	select {
+	case err = <-r:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("http publish not resumed")
+	}
+}
+
+func TestFlowIgnored(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = ""
+	cfg.FlowQueueHigh = 10
+	cfg.FlowQueueLow = 0
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go app.Run()
+
+	queue := "test_queue_flow_ignored"
+
+	//publisher ignores Flow and never waits reply
+	co, err := net.Dial("tcp", app.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+
+	e := proto.NewEncoder(co)
+	high := cfg.FlowQueueHigh
+	n := high + maxDelayedPublishes + 2
+	for i := 0; i < n; i++ {
+		p := proto.NewPublishProto(queue, "", "direct", []byte("1")).P
+		p.Fields[proto.ReqIdStr] = strconv.Itoa(i)
+		if err = e.Encode(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//msgs are not saved after queue is blocked
+	time.Sleep(300 * time.Millisecond)
+	if l, err := app.ms.Len(queue); err != nil || l != high {
+		t.Fatal("blocked msgs saved", l, err)
+	}
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, app.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		return nil
+	}, &client.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	//replies are in publish order, delayed publishes over max are rejected
+	co.SetReadDeadline(time.Now().Add(10 * time.Second))
+	d := proto.NewDecoder(co)
+	next := func() *proto.Proto {
+		p, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	lastId := int64(-1)
+	for i := 0; i < n; i++ {
+		p := next()
+		if i == high {
+			if p.Method != proto.Flow || p.Value(proto.ActiveStr) != "0" {
+				t.Fatal("flow not paused", p.Method)
+			}
+			p = next()
+		}
+
+		if p.ReqId() != strconv.Itoa(i) {
+			t.Fatal("reply out of order", p.ReqId(), i)
+		}
+
+		if i < high+maxDelayedPublishes {
+			id, _ := strconv.ParseInt(string(p.Body), 10, 64)
+			if p.Method != proto.Publish_OK || id <= lastId {
+				t.Fatal(i, p.Method, string(p.Body))
+			}
+			lastId = id
+		} else if p.Method != proto.Error || p.Value(proto.CodeStr) != "503" {
+			t.Fatal(i, p.Method, string(p.Body))
+		}
+	}
+
+	if p := next(); p.Method != proto.Flow || p.Value(proto.ActiveStr) != "1" {
+		t.Fatal("flow not resumed", p.Method)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = ""
+	cfg.MaxMessageSize = 64 * 1024
+	cfg.WriteTimeout = 1
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go app.Run()
+
+	queue := "test_queue_slow_consumer"
+
+	//no ack consumer never reads pushes
+	co, err := net.Dial("tcp", app.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+
+	if err = proto.NewEncoder(co).Encode(proto.NewBindProto(queue, "", true).P); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, app.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	bound := func() int {
+		rq := app.qs.Getx(queue)
+		if rq == nil {
+			return 0
+		}
+
+		info, err := rq.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(info.Channels)
+	}
+
+	for i := 0; bound() == 0; i++ {
+		if i == 100 {
+			t.Fatal("bind timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//queue and publisher are blocked at most write timeout each time,
+	//then slow consumer is closed and unbound
+	body := make([]byte, cfg.MaxMessageSize)
+	start := time.Now()
+	for n := 0; bound() != 0; n++ {
+		if time.Now().Sub(start) > 20*time.Second {
+			t.Fatal("slow consumer not closed", n)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = cli.PublishContext(ctx, queue, "", body, "direct")
+		cancel()
+		if err != nil {
+			t.Fatal(n, err)
+		}
+	}
+}
+
+func TestSlowSSEConsumer(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = "127.0.0.1:0"
+	cfg.MaxMessageSize = 64 * 1024
+	cfg.WriteTimeout = 1
+
+	app, err := NewAppWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go app.Run()
+
+	queue := "test_queue_slow_sse"
+
+	//sse consumer never reads events
+	co, err := net.Dial("tcp", app.HttpAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+
+	if _, err = fmt.Fprintf(co, "GET /msg/sse?queue=%s HTTP/1.1\r\nHost: %s\r\n\r\n", queue, app.HttpAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, app.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	//queue goroutine blocked by push can't reply info
+	bound := func() int {
+		rq := app.qs.Getx(queue)
+		if rq == nil {
+			return 0
+		}
+
+		infos := make(chan *queueInfo, 1)
+		go func() {
+			info, _ := rq.Info()
+			infos <- info
+		}()
+
+		select {
+		case info := <-infos:
+			if info == nil {
+				return 0
+			}
+			return len(info.Channels)
+		case <-time.After(5 * time.Second):
+			t.Fatal("queue blocked by slow sse consumer")
+			return 0
+		}
+	}
+
+	for i := 0; bound() == 0; i++ {
+		if i == 100 {
+			t.Fatal("bind timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//push blocks at most write timeout, then sse stream ends and unbinds
+	body := make([]byte, cfg.MaxMessageSize)
+	start := time.Now()
+	for n := 0; bound() != 0; n++ {
+		if time.Now().Sub(start) > 20*time.Second {
+			t.Fatal("slow sse consumer not closed", n)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = cli.PublishContext(ctx, queue, "", body, "direct")
+		cancel()
+		if err != nil {
+			t.Fatal(n, err)
+		}
+	}
+}
+
+type testSpan struct {
+	t      *testTracer
+	name   string
+	parent proto.TraceContext
+	ctx    proto.TraceContext
+	attrs  map[string]string
+}
+
+func (s *testSpan) Context() proto.TraceContext { return s.ctx }
+
+func (s *testSpan) SetAttribute(key string, value string) { s.attrs[key] = value }
+
+func (s *testSpan) End(err error) {
+	s.t.Lock()
+	s.t.spans = append(s.t.spans, s)
+	s.t.Unlock()
+}
+
+type testTracer struct {
+	sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(name string, parent proto.TraceContext, attrs map[string]string) Span {
+	s := &testSpan{t: t, name: name, parent: parent, attrs: attrs}
+	if parent.Valid() {
+		s.ctx = parent.NewChild()
+	} else {
+		s.ctx = proto.NewTraceContext()
+	}
+	return s
+}
+
+//span returns ended span of name whose context is ctx, or whose parent is
+//parent if ctx is invalid
+func (t *testTracer) span(name string, ctx proto.TraceContext, parent proto.TraceContext) *testSpan {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, s := range t.spans {
+		if s.name == name && (s.ctx == ctx || (!ctx.Valid() && s.parent == parent)) {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	app := getTestApp()
+
+	tracer := new(testTracer)
+	app.SetTracer(tracer)
+	defer app.SetTracer(nil)
+
+	c := getClientConn()
+	defer c.Close()
+
+	queue := "test_queue_trace"
+
+	ds := make(chan *client.Delivery, 2)
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		ds <- d
+		return nil
+	}, &client.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	//http publisher
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("POST", testHttpUrl("/msg?queue="+queue+"&pub_type=direct"), strings.NewReader("hello"))
+	req.Header.Set("traceparent", traceparent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	//tcp publisher injects trace of ctx
+	root := proto.NewTraceContext()
+	if _, err = c.PublishContext(client.ContextWithTrace(context.Background(), root), queue, "", []byte("world"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, _ := proto.ParseTraceparent(traceparent)
+	for _, p := range []proto.TraceContext{parent, root} {
+		var d *client.Delivery
+		select {
+		case d = <-ds:
+		case <-time.After(2 * time.Second):
+			t.Fatal("wait delivery timeout")
+		}
+
+		tc, ok := d.Trace()
+		if !ok || tc.TraceID != p.TraceID {
+			t.Fatal(d.Headers)
+		}
+
+		//publisher -> publish -> route -> deliver -> consumer
+		deliver := tracer.span(SpanDeliver, tc, proto.TraceContext{})
+		if deliver == nil {
+			t.Fatal("no deliver span", tc)
+		}
+		route := tracer.span(SpanRoute, deliver.parent, proto.TraceContext{})
+		if route == nil {
+			t.Fatal("no route span", deliver.parent)
+		}
+		publish := tracer.span(SpanPublish, route.parent, proto.TraceContext{})
+		if publish == nil || publish.parent != p || publish.attrs["queue"] != queue {
+			t.Fatal("invalid publish span", route.parent)
+		}
+
+		//delivery context continues the trace
+		if ctx, ok := client.TraceFromContext(d.Context()); !ok || ctx != tc {
+			t.Fatal(ctx)
+		}
+	}
+
+	//ack is async, its parent is publish span
+	publish := tracer.span(SpanPublish, proto.TraceContext{}, root)
+	for i := 0; i < 100; i++ {
+		if ack := tracer.span(SpanAck, proto.TraceContext{}, publish.ctx); ack != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no ack span")
+}
@@ -1,5 +1,7 @@
 package broker
 
+//msgPusher must not ack or nack in Push, queue waits Push done, and it
+//acks msg pushed to no ack channel itself
 type msgPusher interface {
 	Push(ch *channel, m *msg) error
 }
@@ -22,7 +24,10 @@ func newChannel(p msgPusher, q *queue, routingKey string, noAck bool) *channel {
 	ch.routingKey = routingKey
 	ch.noAck = noAck
 
-	q.Bind(ch)
+	//queue may be deleted after got, bind a new one with same name then
+	for ch.q.Bind(ch) == errQueueDeleted {
+		ch.q = q.qs.Get(q.name)
+	}
 
 	return ch
 }
@@ -43,3 +48,12 @@ func (c *channel) Push(m *msg) error {
 func (c *channel) Ack(msgId int64) {
 	c.q.Ack(msgId)
 }
+
+//Nack pushes msg again, or discards it if not requeue
+func (c *channel) Nack(msgId int64, requeue bool) {
+	c.q.Nack(c, msgId, requeue)
+}
+
+func (c *channel) Info() *channelInfo {
+	return &channelInfo{c.q.name, c.routingKey, c.noAck}
+}
@@ -3,9 +3,17 @@ package broker
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/siddontang/moonmq/proto"
 	"io/ioutil"
+	"time"
 )
 
+const defaultKeepAlive = 65
+
+const defaultWriteTimeout = 10
+
+const defaultMaxMessageSize = 1024 * 1024
+
 type Config struct {
 	Version uint32 `json:"version"`
 
@@ -15,10 +23,39 @@ type Config struct {
 
 	KeepAlive int `json:"keepalive"`
 
+	//seconds a tcp write can block, conn is closed after it, so a consumer
+	//not reading can't block its queues forever. msgs waiting ack of the
+	//conn are pushed again, no ack msgs pushed but not read are lost
+	WriteTimeout int `json:"write_timeout"`
+
+	//publish body larger than it is rejected with 413, compressed or not,
+	//a compressed one as soon as it decompresses larger than it
 	MaxMessageSize int `json:"max_msg_size"`
 	MessageTimeout int `json:"msg_timeout"`
 	MaxQueueSize   int `json:"max_queue_size"`
 
+	//default seconds http get msg waits if queue is empty
+	HttpPollTimeout int `json:"http_poll_timeout"`
+
+	//seconds a msg got by http with ack is leased, not acked msg will be pushed again after it
+	HttpLeaseTimeout int `json:"http_lease_timeout"`
+
+	//push body not less than it is compressed if client negotiated compression
+	CompressThreshold int `json:"compress_threshold"`
+
+	//publisher flow control, 0 means disabled
+	//memory watermark is in bytes of go heap in use
+	FlowMemoryHigh int64 `json:"flow_memory_high"`
+	FlowQueueHigh  int   `json:"flow_queue_high"`
+	FlowQueueLow   int   `json:"flow_queue_low"`
+
+	//admin http api is disabled if empty, otherwise requests must use
+	//basic auth with it as password
+	AdminPassword string `json:"admin_password"`
+
+	//trace, debug, info, warn, error or fatal, empty for info
+	LogLevel string `json:"log_level"`
+
 	Store       string          `json:"store"`
 	StoreConfig json.RawMessage `json:"store_config"`
 }
@@ -26,16 +63,27 @@ type Config struct {
 func NewDefaultConfig() *Config {
 	cfg := new(Config)
 
-	cfg.Version = 1
+	cfg.Version = proto.Version
 	cfg.Addr = "127.0.0.1:11181"
 	cfg.HttpAddr = "127.0.0.1:11180"
 
-	cfg.KeepAlive = 65
+	cfg.KeepAlive = defaultKeepAlive
+
+	cfg.WriteTimeout = defaultWriteTimeout
 
-	cfg.MaxMessageSize = 1024
+	cfg.MaxMessageSize = defaultMaxMessageSize
 	cfg.MessageTimeout = 3600 * 24
 	cfg.MaxQueueSize = 1024
 
+	cfg.HttpPollTimeout = 60
+	cfg.HttpLeaseTimeout = 60
+
+	cfg.CompressThreshold = proto.DefaultCompressThreshold
+
+	cfg.FlowMemoryHigh = 0
+	cfg.FlowQueueHigh = 0
+	cfg.FlowQueueLow = 0
+
 	cfg.Store = "mem"
 	cfg.StoreConfig = nil
 
@@ -50,13 +98,77 @@ func parseConfigJson(buf json.RawMessage) (*Config, error) {
 		return nil, err
 	}
 
-	if cfg.KeepAlive > 600 {
-		return nil, fmt.Errorf("keepalive must less than 600s, not %d", cfg.KeepAlive)
+	if cfg.Version == 0 || cfg.Version > proto.Version {
+		cfg.Version = proto.Version
+	}
+
+	if cfg.HttpPollTimeout <= 0 {
+		cfg.HttpPollTimeout = 60
+	}
+
+	if cfg.HttpLeaseTimeout <= 0 {
+		cfg.HttpLeaseTimeout = 60
+	}
+
+	if cfg.CompressThreshold <= 0 {
+		cfg.CompressThreshold = proto.DefaultCompressThreshold
+	}
+
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = defaultKeepAlive
+	}
+
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = defaultMaxMessageSize
+	}
+
+	if err := cfg.validateKeepAlive(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.LogLevel {
+	case "", "trace", "debug", "info", "warn", "error", "fatal":
+	default:
+		return nil, fmt.Errorf("invalid log_level %s", cfg.LogLevel)
+	}
+
+	if cfg.FlowQueueHigh > 0 {
+		if cfg.FlowQueueLow <= 0 {
+			cfg.FlowQueueLow = cfg.FlowQueueHigh / 2
+		} else if cfg.FlowQueueLow > cfg.FlowQueueHigh {
+			return nil, fmt.Errorf("flow_queue_low %d must not greater than flow_queue_high %d", cfg.FlowQueueLow, cfg.FlowQueueHigh)
+		}
 	}
 
 	return cfg, nil
 }
 
+func (cfg *Config) validateKeepAlive() error {
+	if cfg.KeepAlive <= 0 || cfg.KeepAlive > 600 {
+		return fmt.Errorf("keepalive must be in (0, 600]s, not %d", cfg.KeepAlive)
+	}
+	return nil
+}
+
+//keepAliveDuration never returns a non-positive duration, tickers panic with it
+func (cfg *Config) keepAliveDuration() time.Duration {
+	if cfg.KeepAlive <= 0 {
+		return defaultKeepAlive * time.Second
+	}
+	return time.Duration(cfg.KeepAlive) * time.Second
+}
+
+func (cfg *Config) writeTimeoutDuration() time.Duration {
+	if cfg.WriteTimeout <= 0 {
+		return defaultWriteTimeout * time.Second
+	}
+	return time.Duration(cfg.WriteTimeout) * time.Second
+}
+
 func parseConfigFile(configFile string) (*Config, error) {
 	buf, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -1,11 +1,11 @@
 package broker
 
 import (
-	"fmt"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/moonmq/proto"
 	"io"
 	"net"
+	"net/http"
 	"runtime"
 	"sync"
 	"time"
@@ -16,13 +16,33 @@ type conn struct {
 
 	app *App
 
+	id int64
+
 	c net.Conn
 
 	decoder *proto.Decoder
+	encoder *proto.Encoder
+
+	version uint32
 
 	lastUpdate int64
 
+	//only changed in read goroutine, chLock protects reading in others
+	chLock   sync.Mutex
 	channels map[string]*channel
+
+	getLock sync.Mutex
+	//msgs leased by get, waiting ack
+	gets map[string]*getLease
+
+	flowLock sync.Mutex
+	//publishes delayed by flow control, saved and replied in order
+	flowPubs []*delayedPublish
+	//delayed publishes not rejected, at most maxDelayedPublishes
+	flowDelayed int
+
+	//closed when read loop exits
+	quit chan struct{}
 }
 
 func newConn(app *App, co net.Conn) *conn {
@@ -32,28 +52,68 @@ func newConn(app *App, co net.Conn) *conn {
 	c.c = co
 
 	c.decoder = proto.NewDecoder(co)
+	c.encoder = proto.NewEncoder(co)
+
+	c.version = proto.Version
 
 	c.checkKeepAlive()
 
 	c.channels = make(map[string]*channel)
 
+	c.gets = make(map[string]*getLease)
+
+	c.quit = make(chan struct{})
+
 	return c
 }
 
 func (c *conn) run() {
+	defer c.app.removeConn(c)
+
 	c.onRead()
 
+	close(c.quit)
+
 	c.unBindAll()
 
+	c.closeGets()
+
 	c.c.Close()
 }
 
 func (c *conn) unBindAll() {
-	for _, ch := range c.channels {
+	c.chLock.Lock()
+	channels := c.channels
+	c.channels = map[string]*channel{}
+	c.chLock.Unlock()
+
+	for _, ch := range channels {
 		ch.Close()
 	}
+}
+
+type connInfo struct {
+	Id         int64          `json:"id"`
+	RemoteAddr string         `json:"remote_addr"`
+	Version    uint32         `json:"version"`
+	Channels   []*channelInfo `json:"channels"`
+}
+
+func (c *conn) Info() *connInfo {
+	info := new(connInfo)
+
+	info.Id = c.id
+	info.RemoteAddr = c.c.RemoteAddr().String()
+	info.Version = c.version
+
+	c.chLock.Lock()
+	info.Channels = make([]*channelInfo, 0, len(c.channels))
+	for _, ch := range c.channels {
+		info.Channels = append(info.Channels, ch.Info())
+	}
+	c.chLock.Unlock()
 
-	c.channels = map[string]*channel{}
+	return info
 }
 
 func (c *conn) onRead() {
@@ -66,8 +126,15 @@ func (c *conn) onRead() {
 	}()
 
 	for {
+		//max_msg_size may be reloaded
+		c.decoder.SetMaxBodySize(c.app.Config().MaxMessageSize)
+
 		p, err := c.decoder.Decode()
-		if err != nil {
+		if err == proto.ErrBodyTooLarge {
+			//whole proto is read, only its body is dropped
+			c.writeError(p, c.protoError(http.StatusRequestEntityTooLarge, errMsgTooLarge.Error()))
+			continue
+		} else if err != nil {
 			if err != io.EOF {
 				log.Info("on read error %v", err)
 			}
@@ -75,6 +142,16 @@ func (c *conn) onRead() {
 		}
 
 		switch p.Method {
+		case proto.Publish, proto.Bind, proto.Get:
+			if c.app.isClosing() {
+				c.writeError(p, c.protoError(http.StatusServiceUnavailable, "broker is shutting down"))
+				continue
+			}
+		}
+
+		switch p.Method {
+		case proto.Handshake:
+			err = c.handleHandshake(p)
 		case proto.Publish:
 			err = c.handlePublish(p)
 		case proto.Bind:
@@ -83,6 +160,10 @@ func (c *conn) onRead() {
 			err = c.handleUnbind(p)
 		case proto.Ack:
 			err = c.handleAck(p)
+		case proto.Nack:
+			err = c.handleNack(p)
+		case proto.Get:
+			err = c.handleGet(p)
 		case proto.Heartbeat:
 			c.lastUpdate = time.Now().Unix()
 		default:
@@ -91,12 +172,12 @@ func (c *conn) onRead() {
 		}
 
 		if err != nil {
-			c.writeError(err)
+			c.writeError(p, err)
 		}
 	}
 }
 
-func (c *conn) writeError(err error) {
+func (c *conn) writeError(req *proto.Proto, err error) {
 	var p *proto.Proto
 	if pe, ok := err.(*proto.ProtoError); ok {
 		p = pe.P
@@ -105,7 +186,16 @@ func (c *conn) writeError(err error) {
 		p = pe.P
 	}
 
-	c.writeProto(p)
+	c.writeReply(req, p)
+}
+
+//reply echoes req_id of request if supplied
+func (c *conn) writeReply(req *proto.Proto, p *proto.Proto) error {
+	if reqId := req.ReqId(); len(reqId) > 0 {
+		p.Fields[proto.ReqIdStr] = reqId
+	}
+
+	return c.writeProto(p)
 }
 
 func (c *conn) protoError(code int, message string) error {
@@ -113,38 +203,82 @@ func (c *conn) protoError(code int, message string) error {
 }
 
 func (c *conn) writeProto(p *proto.Proto) error {
-	buf, err := proto.Marshal(p)
-	if err != nil {
-		return err
-	}
-
-	var n int
 	c.Lock()
-	n, err = c.c.Write(buf)
+	//a queue goroutine waits push done, a client not reading can't
+	//block it forever
+	c.c.SetWriteDeadline(time.Now().Add(c.app.Config().writeTimeoutDuration()))
+	err := c.encoder.Encode(p)
 	c.Unlock()
 
 	if err != nil {
 		c.c.Close()
 		return err
-	} else if n != len(buf) {
-		c.c.Close()
-		return fmt.Errorf("write incomplete, %d less than %d", n, len(buf))
 	} else {
 		return nil
 	}
 }
 
+func (c *conn) handleHandshake(p *proto.Proto) error {
+	version, err := p.Version()
+	if err != nil || version == 0 {
+		return c.protoError(http.StatusBadRequest, "invalid version")
+	}
+
+	if version > c.app.Config().Version {
+		version = c.app.Config().Version
+	}
+
+	encoding := proto.JsonEncoding
+	for _, e := range p.HeaderEncodings() {
+		if proto.ValidHeaderEncoding(e) {
+			encoding = e
+			break
+		}
+	}
+
+	var compressor proto.Compressor
+	for _, name := range p.Compressions() {
+		if compressor = proto.GetCompressor(name); compressor != nil {
+			break
+		}
+	}
+
+	c.version = version
+
+	var compression string
+	if compressor != nil {
+		compression = compressor.Name()
+
+		//client may compress protos right after receiving reply
+		c.decoder.SetCompressor(compressor)
+	}
+
+	np := proto.NewHandshakeOKProto(version, encoding, compression)
+	if err = c.writeReply(p, np.P); err != nil {
+		return err
+	}
+
+	//decoder detects header encoding, so protos written before this are ok
+	c.Lock()
+	c.encoder.SetHeaderEncoding(encoding)
+	c.encoder.SetCompressor(compressor, c.app.Config().CompressThreshold)
+	c.Unlock()
+
+	return nil
+}
+
 func (c *conn) checkKeepAlive() {
 	var f func()
 	f = func() {
-		if time.Now().Unix()-c.lastUpdate > int64(1.5*float32(c.app.cfg.KeepAlive)) {
+		keepAlive := c.app.Config().keepAliveDuration()
+		if time.Now().Unix()-c.lastUpdate > int64(1.5*keepAlive.Seconds()) {
 			log.Info("keepalive timeout")
 			c.c.Close()
 			return
 		} else {
-			time.AfterFunc(time.Duration(c.app.cfg.KeepAlive)*time.Second, f)
+			time.AfterFunc(keepAlive, f)
 		}
 	}
 
-	time.AfterFunc(time.Duration(c.app.cfg.KeepAlive)*time.Second, f)
+	time.AfterFunc(c.app.Config().keepAliveDuration(), f)
 }
@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/siddontang/moonmq/proto"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errGetDone = fmt.Errorf("get has been done")
+
+//getLease is a get waiting ack, msgId is -1 until msg is got, so ack for
+//msg pushed to bound channel of same queue is not taken by it
+type getLease struct {
+	ch    *channel
+	msgId int64
+}
+
+//getMsgPusher accepts only one msg for a pull consumer
+type getMsgPusher struct {
+	sync.Mutex
+
+	m    chan *msg
+	done bool
+}
+
+func newGetMsgPusher() *getMsgPusher {
+	p := new(getMsgPusher)
+
+	p.m = make(chan *msg, 1)
+
+	return p
+}
+
+func (p *getMsgPusher) Push(ch *channel, m *msg) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.done {
+		return errGetDone
+	}
+
+	p.done = true
+	p.m <- m
+
+	return nil
+}
+
+//wait msg pushed in timeout, later push will fail
+func (p *getMsgPusher) Wait(q *queue, timeout time.Duration) *msg {
+	if timeout > 0 {
+		select {
+		case m := <-p.m:
+			return m
+		case <-time.After(timeout):
+		case <-q.app.quit:
+		}
+	} else {
+		//bind has pushed msg if there is one
+		q.Sync()
+	}
+
+	p.Lock()
+	p.done = true
+	p.Unlock()
+
+	select {
+	case m := <-p.m:
+		return m
+	default:
+		return nil
+	}
+}
+
+//pullMsgs gets at most count msgs with no ack, waits at most timeout
+//for the first msg if queue is empty
+func pullMsgs(q *queue, routingKey string, count int, timeout time.Duration) []*msg {
+	pusher := newGetMsgPusher()
+	ch := newChannel(pusher, q, routingKey, true)
+
+	m := pusher.Wait(ch.q, timeout)
+
+	ch.Close()
+
+	if m == nil {
+		return nil
+	}
+
+	return append([]*msg{m}, ch.q.Drain(routingKey, count-1)...)
+}
+
+func (c *conn) handleGet(p *proto.Proto) error {
+	queue := p.Queue()
+	routingKey := p.RoutingKey()
+
+	if err := checkBind(queue, routingKey); err != nil {
+		return c.protoError(http.StatusBadRequest, err.Error())
+	}
+
+	noAck := (p.Value(proto.NoAckStr) == "1")
+
+	timeout, err := strconv.ParseInt(p.Value(proto.TimeoutStr), 10, 64)
+	if err != nil || timeout < 0 {
+		return c.protoError(http.StatusBadRequest, "invalid timeout")
+	}
+
+	count, err := strconv.Atoi(p.Value(proto.CountStr))
+	if err != nil || count <= 0 || count > proto.MaxGetCount {
+		return c.protoError(http.StatusBadRequest, "invalid count")
+	}
+
+	q := c.app.qs.Get(queue)
+	wait := time.Duration(timeout) * time.Millisecond
+
+	var pusher *getMsgPusher
+	var ch *channel
+	if !noAck {
+		//a queue pushes one msg at a time, so we can lease only one
+		c.getLock.Lock()
+		if _, ok := c.gets[queue]; ok {
+			c.getLock.Unlock()
+			return c.protoError(http.StatusForbidden, "previous get msg not acked")
+		}
+
+		pusher = newGetMsgPusher()
+		ch = newChannel(pusher, q, routingKey, false)
+		c.gets[queue] = &getLease{ch, -1}
+		c.getLock.Unlock()
+	}
+
+	//wait in another goroutine, so we can still handle other requests
+	go func() {
+		var ms []*msg
+		if noAck {
+			ms = pullMsgs(q, routingKey, count, wait)
+		} else if m := pusher.Wait(ch.q, wait); m == nil {
+			c.closeGet(queue, ch)
+		} else {
+			c.getLock.Lock()
+			if l, ok := c.gets[queue]; ok && l.ch == ch {
+				l.msgId = m.id
+			}
+			c.getLock.Unlock()
+
+			ms = []*msg{m}
+		}
+
+		if len(ms) == 0 {
+			np := proto.NewGetEmptyProto(queue)
+			c.writeReply(p, np.P)
+			return
+		}
+
+		gms := make([]*proto.GetMsg, 0, len(ms))
+		for _, m := range ms {
+			gms = append(gms, &proto.GetMsg{MsgId: m.id, Body: m.body})
+		}
+
+		np := proto.NewGetOKProto(queue, gms)
+		c.writeReply(p, np.P)
+	}()
+
+	return nil
+}
+
+//takeGet removes lease of queue if msgId is leased by it
+func (c *conn) takeGet(queue string, msgId int64) *channel {
+	c.getLock.Lock()
+	defer c.getLock.Unlock()
+
+	l, ok := c.gets[queue]
+	if !ok || l.msgId != msgId {
+		return nil
+	}
+
+	delete(c.gets, queue)
+	return l.ch
+}
+
+//ack msg leased by get, return false if msg is not leased
+func (c *conn) ackGet(queue string, msgId int64) bool {
+	ch := c.takeGet(queue, msgId)
+	if ch == nil {
+		return false
+	}
+
+	ch.Ack(msgId)
+	ch.Close()
+
+	return true
+}
+
+//nack msg leased by get, return false if msg is not leased
+func (c *conn) nackGet(queue string, msgId int64, requeue bool) bool {
+	ch := c.takeGet(queue, msgId)
+	if ch == nil {
+		return false
+	}
+
+	ch.Nack(msgId, requeue)
+	ch.Close()
+
+	return true
+}
+
+func (c *conn) closeGet(queue string, ch *channel) {
+	c.getLock.Lock()
+	if l, ok := c.gets[queue]; ok && l.ch == ch {
+		delete(c.gets, queue)
+	}
+	c.getLock.Unlock()
+
+	ch.Close()
+}
+
+//not acked msgs will be pushed again
+func (c *conn) closeGets() {
+	c.getLock.Lock()
+	gets := c.gets
+	c.gets = map[string]*getLease{}
+	c.getLock.Unlock()
+
+	for _, l := range gets {
+		l.ch.Close()
+	}
+}
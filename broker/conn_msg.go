@@ -27,16 +27,46 @@ func checkPublish(queue string, routingKey string, tp string, message []byte) er
 	return nil
 }
 
-func (app *App) saveMsg(queue string, routingKey string, tp string, message []byte) (*msg, error) {
+var errMsgTooLarge = fmt.Errorf("msg body larger than max_msg_size")
+
+func (app *App) checkMsgSize(message []byte) error {
+	if len(message) > app.Config().MaxMessageSize {
+		return errMsgTooLarge
+	}
+
+	return nil
+}
+
+func (app *App) saveMsg(queue string, routingKey string, tp string, headers map[string]string, message []byte) (*msg, error) {
+	parent, _ := proto.TraceFromHeaders(headers)
+	span := app.startSpan(SpanPublish, parent, map[string]string{
+		"queue":       queue,
+		"routing_key": routingKey,
+		"pub_type":    tp,
+	})
+
+	headers, _ = withTrace(headers, span)
+
+	msg, err := app.doSaveMsg(queue, routingKey, tp, headers, message)
+	if err == nil {
+		span.SetAttribute("msg_id", strconv.FormatInt(msg.id, 10))
+	}
+	span.End(err)
+
+	return msg, err
+}
+
+func (app *App) doSaveMsg(queue string, routingKey string, tp string, headers map[string]string, message []byte) (*msg, error) {
 	t, _ := proto.PublishTypeMap[strings.ToLower(tp)]
 
-	if app.cfg.MaxQueueSize > 0 {
+	if app.Config().MaxQueueSize > 0 {
 		if n, err := app.ms.Len(queue); err != nil {
 			return nil, err
-		} else if n >= app.cfg.MaxQueueSize {
+		} else if n >= app.Config().MaxQueueSize {
 			if err = app.ms.Pop(queue); err != nil {
 				return nil, err
 			}
+			app.metrics.discards.Inc()
 		}
 	}
 
@@ -46,15 +76,27 @@ func (app *App) saveMsg(queue string, routingKey string, tp string, message []by
 	}
 
 	msg := newMsg(id, t, routingKey, message)
+	msg.headers = headers
 
 	if err := app.ms.Save(queue, msg); err != nil {
 		return nil, err
 	}
 
+	app.metrics.publishes.Inc()
+
 	return msg, nil
 }
 
 func (c *conn) handlePublish(p *proto.Proto) error {
+	if c.delayPublish(p) {
+		return nil
+	}
+
+	return c.publish(p)
+}
+
+//publish saves msg and replies Publish_OK
+func (c *conn) publish(p *proto.Proto) error {
 	tp := p.PubType()
 	queue := p.Queue()
 	routingKey := p.RoutingKey()
@@ -63,9 +105,16 @@ func (c *conn) handlePublish(p *proto.Proto) error {
 
 	if err := checkPublish(queue, routingKey, tp, message); err != nil {
 		return c.protoError(http.StatusBadRequest, err.Error())
+	} else if err = c.app.checkMsgSize(message); err != nil {
+		return c.protoError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+
+	headers, err := p.Headers()
+	if err != nil {
+		return c.protoError(http.StatusBadRequest, fmt.Sprintf("invalid headers, %s", err.Error()))
 	}
 
-	msg, err := c.app.saveMsg(queue, routingKey, tp, message)
+	msg, err := c.app.saveMsg(queue, routingKey, tp, headers, message)
 	if err != nil {
 		return c.protoError(http.StatusInternalServerError, err.Error())
 	}
@@ -74,12 +123,94 @@ func (c *conn) handlePublish(p *proto.Proto) error {
 	q.Push(msg)
 
 	np := proto.NewPublishOKProto(strconv.FormatInt(msg.id, 10))
-
-	c.writeProto(np.P)
+	c.writeReply(p, np.P)
 
 	return nil
 }
 
+//a publisher ignoring Flow can't make broker hold more publishes than it,
+//later ones are rejected in order until delayed ones are done
+const maxDelayedPublishes = 128
+
+type delayedPublish struct {
+	p *proto.Proto
+
+	reject bool
+}
+
+//delayPublish delays p if its queue is blocked by flow control, or
+//publishes delayed before are not done, so replies are in order. one
+//goroutine of conn waits flow resuming and publishes them, read loop goes
+//on reading, acks of conn may be the only way to drain queue
+func (c *conn) delayPublish(p *proto.Proto) bool {
+	c.flowLock.Lock()
+	defer c.flowLock.Unlock()
+
+	if len(c.flowPubs) == 0 && !c.app.flow.blocked(p.Queue(), false) {
+		return false
+	}
+
+	d := &delayedPublish{p: p}
+	if c.flowDelayed >= maxDelayedPublishes {
+		//only reply is needed
+		d.reject = true
+		p.Body = nil
+	} else {
+		c.flowDelayed++
+	}
+
+	c.flowPubs = append(c.flowPubs, d)
+
+	if len(c.flowPubs) == 1 {
+		c.writeProto(proto.NewFlowProto(false).P)
+		go c.runDelayedPublishes()
+	}
+
+	return true
+}
+
+//runDelayedPublishes exits and tells publisher to go on when all
+//delayed publishes are done
+func (c *conn) runDelayedPublishes() {
+	for {
+		c.flowLock.Lock()
+		if len(c.flowPubs) == 0 {
+			c.writeProto(proto.NewFlowProto(true).P)
+			c.flowLock.Unlock()
+			return
+		}
+		d := c.flowPubs[0]
+		c.flowLock.Unlock()
+
+		//a publish delayed only to keep order goes on if its queue is not
+		//blocked, others wait until queue drops to low watermark
+		var err error
+		queue := d.p.Queue()
+		if d.reject {
+			err = c.protoError(http.StatusServiceUnavailable, "too many publishes delayed by flow control")
+		} else if c.app.flow.blocked(queue, false) && !c.app.flow.wait(queue, c.quit) {
+			//conn is closed, delayed publishes are not saved
+			return
+		} else if c.app.isClosing() {
+			err = c.protoError(http.StatusServiceUnavailable, "broker is shutting down")
+		} else {
+			err = c.publish(d.p)
+		}
+
+		if err != nil {
+			c.writeError(d.p, err)
+		}
+
+		c.flowLock.Lock()
+		c.flowPubs[0] = nil
+		c.flowPubs = c.flowPubs[1:]
+		if !d.reject {
+			c.flowDelayed--
+		}
+		c.flowLock.Unlock()
+	}
+}
+
 func (c *conn) handleAck(p *proto.Proto) error {
 	queue := p.Queue()
 
@@ -87,17 +218,49 @@ func (c *conn) handleAck(p *proto.Proto) error {
 		return c.protoError(http.StatusForbidden, "queue must supplied")
 	}
 
+	msgId, err := strconv.ParseInt(p.MsgId(), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if c.ackGet(queue, msgId) {
+		return nil
+	}
+
 	ch, ok := c.channels[queue]
 	if !ok {
 		return c.protoError(http.StatusForbidden, "invalid queue")
 	}
 
+	ch.Ack(msgId)
+
+	return nil
+}
+
+func (c *conn) handleNack(p *proto.Proto) error {
+	queue := p.Queue()
+
+	if len(queue) == 0 {
+		return c.protoError(http.StatusForbidden, "queue must supplied")
+	}
+
 	msgId, err := strconv.ParseInt(p.MsgId(), 10, 64)
 	if err != nil {
 		return err
 	}
 
-	ch.Ack(msgId)
+	requeue := (p.Value(proto.RequeueStr) != "0")
+
+	if c.nackGet(queue, msgId, requeue) {
+		return nil
+	}
+
+	ch, ok := c.channels[queue]
+	if !ok {
+		return c.protoError(http.StatusForbidden, "invalid queue")
+	}
+
+	ch.Nack(msgId, requeue)
 
 	return nil
 }
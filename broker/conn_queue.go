@@ -25,14 +25,9 @@ type connMsgPusher struct {
 func (p *connMsgPusher) Push(ch *channel, m *msg) error {
 	po := proto.NewPushProto(ch.q.name,
 		strconv.FormatInt(m.id, 10), m.body)
+	po.P.SetHeaders(m.headers)
 
-	err := p.c.writeProto(po.P)
-
-	if err == nil && ch.noAck {
-		ch.Ack(m.id)
-	}
-
-	return err
+	return p.c.writeProto(po.P)
 }
 
 func (c *conn) handleBind(p *proto.Proto) error {
@@ -49,14 +44,16 @@ func (c *conn) handleBind(p *proto.Proto) error {
 	if !ok {
 		q := c.app.qs.Get(queue)
 		ch = newChannel(&connMsgPusher{c}, q, routingKey, noAck)
+		c.chLock.Lock()
 		c.channels[queue] = ch
+		c.chLock.Unlock()
 	} else {
 		ch.Reset(routingKey, noAck)
 	}
 
 	np := proto.NewBindOKProto(queue)
 
-	c.writeProto(np.P)
+	c.writeReply(p, np.P)
 
 	return nil
 }
@@ -68,18 +65,20 @@ func (c *conn) handleUnbind(p *proto.Proto) error {
 
 		np := proto.NewUnbindOKProto(queue)
 
-		c.writeProto(np.P)
+		c.writeReply(p, np.P)
 		return nil
 	}
 
 	if ch, ok := c.channels[queue]; ok {
+		c.chLock.Lock()
 		delete(c.channels, queue)
+		c.chLock.Unlock()
 		ch.Close()
 	}
 
 	np := proto.NewUnbindOKProto(queue)
 
-	c.writeProto(np.P)
+	c.writeReply(p, np.P)
 
 	return nil
 }
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	publisher flow control, refer rabbitmq
+
+	when go heap in use reaches flow_memory_high, or a queue has
+	flow_queue_high msgs, publish to it is blocked before saving msg:
+
+	1, broker sends Flow with active 0 to the conn
+	2, broker delays the publish, and all later ones of the conn, so
+		replies are in order, but still reads the conn, so acks of the
+		conn can drain queue. delayed publishes more than 128 are
+		rejected with 503, so a publisher ignoring Flow can't make
+		broker hold more
+	3, when memory drops under flow_memory_high and queue depth drops to
+		flow_queue_low, broker saves delayed msgs and sends Publish_OK,
+		and Flow with active 1 after all delayed publishes of the conn
+		are done
+
+	http publisher is blocked the same way, only without Flow, until
+	request is canceled, msg is not saved then.
+*/
+
+const flowCheckInterval = 100 * time.Millisecond
+
+type flow struct {
+	app *App
+
+	memBlocked int32
+
+	quit chan struct{}
+}
+
+func newFlow(app *App) *flow {
+	f := new(flow)
+
+	f.app = app
+
+	f.quit = make(chan struct{})
+
+	//always run, flow_memory_high may be changed by reload
+	go f.run()
+
+	return f
+}
+
+func (f *flow) run() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	var st runtime.MemStats
+	for {
+		select {
+		case <-t.C:
+			high := f.app.Config().FlowMemoryHigh
+			if high <= 0 {
+				atomic.StoreInt32(&f.memBlocked, 0)
+				continue
+			}
+
+			runtime.ReadMemStats(&st)
+
+			if int64(st.HeapInuse) >= high {
+				atomic.StoreInt32(&f.memBlocked, 1)
+			} else {
+				atomic.StoreInt32(&f.memBlocked, 0)
+			}
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+func (f *flow) Close() {
+	close(f.quit)
+}
+
+//resuming uses low watermark for queue depth
+func (f *flow) blocked(queue string, resuming bool) bool {
+	if atomic.LoadInt32(&f.memBlocked) == 1 {
+		return true
+	}
+
+	cfg := f.app.Config()
+	if cfg.FlowQueueHigh <= 0 {
+		return false
+	}
+
+	n, err := f.app.ms.Len(queue)
+	if err != nil {
+		return false
+	}
+
+	if resuming {
+		return n > cfg.FlowQueueLow
+	} else {
+		return n >= cfg.FlowQueueHigh
+	}
+}
+
+//wait until queue can be published again, return false if done is
+//closed before it
+func (f *flow) wait(queue string, done <-chan struct{}) bool {
+	for !f.app.isClosing() && f.blocked(queue, true) {
+		select {
+		case <-done:
+			return false
+		case <-time.After(flowCheckInterval):
+		}
+	}
+
+	return true
+}
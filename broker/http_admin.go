@@ -0,0 +1,287 @@
+package broker
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+/*
+	http admin api
+
+	disabled unless admin_password is configured, requests must use http
+	basic auth with admin_password as password, user name is ignored
+
+	GET /admin/queues
+		list all queues, return {"queues":[queue info...]}
+
+	GET /admin/queue?name=xxx
+		inspect queue, return queue info
+
+	DELETE /admin/queue?name=xxx
+		purge and delete queue, return 409 if queue has bound channels
+
+	POST /admin/queue/purge?name=xxx
+		delete all msgs in queue
+
+	GET /admin/queue/peek?name=xxx[&count=xxx]
+		return at most count(default 1) head msgs without consuming them,
+		{"msgs":[...]}, msg format is same as batch api
+
+	GET /admin/conns
+		list all tcp conns with bound channels, return {"conns":[conn info...]}
+
+	DELETE /admin/conn?id=xxx
+		force close conn, its unacked msgs will be pushed again
+
+	POST /admin/reload
+		reload config file, return {"applied":[...], "restart_required":[...]},
+		see reload.go
+
+	queue info is
+
+	{
+		"name": "xxx",
+		"depth": 1,
+		"waiting_ack_id": -1, (-1 if no msg waiting ack)
+		"channels": [{"queue": "xxx", "routing_key": "xxx", "no_ack": false}]
+	}
+*/
+
+type AdminHandler struct {
+	app *App
+}
+
+func newAdminHandler(app *App) *AdminHandler {
+	h := new(AdminHandler)
+
+	h.app = app
+
+	return h
+}
+
+func (h *AdminHandler) register(mux *http.ServeMux) {
+	mux.Handle("/admin/queues", h.auth(h.listQueues))
+	mux.Handle("/admin/queue", h.auth(h.queue))
+	mux.Handle("/admin/queue/purge", h.auth(h.purgeQueue))
+	mux.Handle("/admin/queue/peek", h.auth(h.peekQueue))
+	mux.Handle("/admin/conns", h.auth(h.listConns))
+	mux.Handle("/admin/conn", h.auth(h.conn))
+	mux.Handle("/admin/reload", h.auth(h.reload))
+}
+
+func (h *AdminHandler) auth(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(h.app.passMD5) == 0 {
+			http.Error(w, "admin api is disabled", http.StatusForbidden)
+			return
+		}
+
+		_, pass, _ := r.BasicAuth()
+		sum := md5.Sum([]byte(pass))
+		if subtle.ConstantTimeCompare(sum[:], h.app.passMD5) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="moonmq admin"`)
+			http.Error(w, "invalid admin password", http.StatusUnauthorized)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+func (h *AdminHandler) listQueues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	qs := h.app.qs.List()
+
+	infos := make([]*queueInfo, 0, len(qs))
+	for _, rq := range qs {
+		info, err := rq.Info()
+		if err == errQueueDeleted {
+			continue
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		infos = append(infos, info)
+	}
+
+	writeJson(w, map[string]interface{}{"queues": infos})
+}
+
+func (h *AdminHandler) getQueue(w http.ResponseWriter, r *http.Request) *queue {
+	name := r.FormValue("name")
+	if len(name) == 0 {
+		http.Error(w, "empty queue name", http.StatusBadRequest)
+		return nil
+	}
+
+	rq := h.app.qs.Getx(name)
+	if rq == nil {
+		http.Error(w, fmt.Sprintf("queue %s not exist", name), http.StatusNotFound)
+		return nil
+	}
+
+	return rq
+}
+
+func (h *AdminHandler) queue(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		h.inspectQueue(w, r)
+	case "DELETE":
+		h.deleteQueue(w, r)
+	default:
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *AdminHandler) inspectQueue(w http.ResponseWriter, r *http.Request) {
+	rq := h.getQueue(w, r)
+	if rq == nil {
+		return
+	}
+
+	info, err := rq.Info()
+	if err == errQueueDeleted {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, info)
+}
+
+func (h *AdminHandler) deleteQueue(w http.ResponseWriter, r *http.Request) {
+	rq := h.getQueue(w, r)
+	if rq == nil {
+		return
+	}
+
+	if err := rq.Delete(); err == errQueueBound {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if err == errQueueDeleted {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *AdminHandler) purgeQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rq := h.getQueue(w, r)
+	if rq == nil {
+		return
+	}
+
+	if err := rq.Purge(); err == errQueueDeleted {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *AdminHandler) peekQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rq := h.getQueue(w, r)
+	if rq == nil {
+		return
+	}
+
+	count := 1
+	if v := r.FormValue("count"); len(v) > 0 {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil || count <= 0 || count > maxHttpBatch {
+			http.Error(w, fmt.Sprintf("count must be in [1, %d]", maxHttpBatch), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ms, err := h.app.ms.Peek(rq.name, count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hms := make([]*httpMsg, 0, len(ms))
+	for _, m := range ms {
+		hms = append(hms, newHttpMsg(m))
+	}
+
+	writeJson(w, map[string]interface{}{"msgs": hms})
+}
+
+func (h *AdminHandler) listConns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cs := h.app.listConns()
+
+	infos := make([]*connInfo, 0, len(cs))
+	for _, c := range cs {
+		infos = append(infos, c.Info())
+	}
+
+	writeJson(w, map[string]interface{}{"conns": infos})
+}
+
+func (h *AdminHandler) conn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid conn id", http.StatusBadRequest)
+		return
+	}
+
+	c := h.app.getConn(id)
+	if c == nil {
+		http.Error(w, fmt.Sprintf("conn %d not exist", id), http.StatusNotFound)
+		return
+	}
+
+	//read loop will exit and unbind all channels
+	c.c.Close()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *AdminHandler) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := h.app.ReloadFile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJson(w, result)
+}
@@ -0,0 +1,245 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	http batch msg api
+
+	POST /msg/batch[?queue=xxx&routing_key=xxx&pub_type=xxx]
+		publish msgs, body is a json array of msg, or newline delimited
+		json msgs if content type is application/x-ndjson, query values
+		are used for msg which doesn't supply them.
+		return {"ids":[...]}
+
+	GET /msg/batch?queue=xxx&routing_key=xxx&count=xxx[&timeout=xxx]
+		consume at most count msgs with no ack, wait at most timeout
+		milliseconds if queue is empty.
+		return {"msgs":[...]}
+
+	msg is
+
+	{
+		"id": 1, (only returned)
+		"queue": "xxx", (only published)
+		"routing_key": "xxx",
+		"pub_type": "direct", (only published)
+		"headers": {"xxx": "xxx"},
+		"body": "xxx",
+		"base64": true (body is base64 encoded, for binary body)
+	}
+*/
+
+const maxHttpBatch = 1000
+
+type httpMsg struct {
+	Id         int64             `json:"id,omitempty"`
+	Queue      string            `json:"queue,omitempty"`
+	RoutingKey string            `json:"routing_key"`
+	PubType    string            `json:"pub_type,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body"`
+	Base64     bool              `json:"base64,omitempty"`
+}
+
+func (m *httpMsg) body() ([]byte, error) {
+	if m.Base64 {
+		return base64.StdEncoding.DecodeString(m.Body)
+	} else {
+		return []byte(m.Body), nil
+	}
+}
+
+func newHttpMsg(m *msg) *httpMsg {
+	hm := new(httpMsg)
+
+	hm.Id = m.id
+	hm.RoutingKey = m.routingKey
+	hm.Headers = m.headers
+
+	if utf8.Valid(m.body) {
+		hm.Body = string(m.body)
+	} else {
+		hm.Body = base64.StdEncoding.EncodeToString(m.body)
+		hm.Base64 = true
+	}
+
+	return hm
+}
+
+func (h *MsgHandler) batchMsg(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		h.publishBatch(w, r)
+	case "GET":
+		h.getBatch(w, r)
+	default:
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+	}
+}
+
+func decodeHttpMsgs(r *http.Request) ([]*httpMsg, error) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []*httpMsg
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		s := bufio.NewScanner(bytes.NewReader(buf))
+		s.Buffer(nil, len(buf)+1)
+		for s.Scan() {
+			line := bytes.TrimSpace(s.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			m := new(httpMsg)
+			if err = json.Unmarshal(line, m); err != nil {
+				return nil, err
+			}
+			ms = append(ms, m)
+		}
+
+		if err = s.Err(); err != nil {
+			return nil, err
+		}
+	} else if err = json.Unmarshal(buf, &ms); err != nil {
+		return nil, err
+	}
+
+	return ms, nil
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (h *MsgHandler) publishBatch(w http.ResponseWriter, r *http.Request) {
+	ms, err := decodeHttpMsgs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(ms) == 0 {
+		http.Error(w, "publish empty batch forbidden", http.StatusBadRequest)
+		return
+	} else if len(ms) > maxHttpBatch {
+		http.Error(w, fmt.Sprintf("batch size must not greater than %d", maxHttpBatch), http.StatusBadRequest)
+		return
+	}
+
+	queue := r.FormValue("queue")
+	routingKey := r.FormValue("routing_key")
+	tp := r.FormValue("pub_type")
+
+	//check all before saving any one
+	bodies := make([][]byte, len(ms))
+	for i, m := range ms {
+		if len(m.Queue) == 0 {
+			m.Queue = queue
+		}
+
+		if len(m.RoutingKey) == 0 {
+			m.RoutingKey = routingKey
+		}
+
+		if len(m.PubType) == 0 {
+			m.PubType = tp
+		}
+
+		if bodies[i], err = m.body(); err != nil {
+			http.Error(w, fmt.Sprintf("msg %d: %s", i, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		if err = checkPublish(m.Queue, m.RoutingKey, m.PubType, bodies[i]); err != nil {
+			http.Error(w, fmt.Sprintf("msg %d: %s", i, err.Error()), http.StatusBadRequest)
+			return
+		} else if err = h.app.checkMsgSize(bodies[i]); err != nil {
+			http.Error(w, fmt.Sprintf("msg %d: %s", i, err.Error()), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	//wait all blocked queues before saving any msg
+	waited := map[string]struct{}{}
+	for _, m := range ms {
+		if _, ok := waited[m.Queue]; ok {
+			continue
+		}
+		waited[m.Queue] = struct{}{}
+
+		if h.app.flow.blocked(m.Queue, false) && !h.app.flow.wait(m.Queue, r.Context().Done()) {
+			return
+		}
+	}
+
+	ids := make([]int64, 0, len(ms))
+	for i, m := range ms {
+		sm, err := h.app.saveMsg(m.Queue, m.RoutingKey, m.PubType, m.Headers, bodies[i])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("msg %d: %s", i, err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		h.app.qs.Get(m.Queue).Push(sm)
+
+		ids = append(ids, sm.id)
+	}
+
+	writeJson(w, map[string][]int64{"ids": ids})
+}
+
+func (h *MsgHandler) getBatch(w http.ResponseWriter, r *http.Request) {
+	queue := r.FormValue("queue")
+	routingKey := r.FormValue("routing_key")
+
+	if err := checkBind(queue, routingKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count <= 0 || count > maxHttpBatch {
+		http.Error(w, "invalid count", http.StatusBadRequest)
+		return
+	}
+
+	var timeout int64
+	if v := r.FormValue("timeout"); len(v) > 0 {
+		if timeout, err = strconv.ParseInt(v, 10, 64); err != nil || timeout < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	q := h.app.qs.Get(queue)
+	ms := pullMsgs(q, routingKey, count, time.Duration(timeout)*time.Millisecond)
+
+	hms := make([]*httpMsg, 0, len(ms))
+	for _, m := range ms {
+		hms = append(hms, newHttpMsg(m))
+	}
+
+	writeJson(w, map[string][]*httpMsg{"msgs": hms})
+}
@@ -1,15 +1,61 @@
 package broker
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/siddontang/moonmq/proto"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
+/*
+	http msg api
+
+	POST|PUT /msg?queue=xxx&routing_key=xxx&pub_type=xxx, body is msg
+		publish msg, return msg id, msg headers can be supplied as json
+		object in X-Moonmq-Headers header, w3c traceparent header is saved
+		as msg header traceparent if not in X-Moonmq-Headers
+
+	GET /msg?queue=xxx&routing_key=xxx[&ack=1&timeout=xxx]
+		consume one msg, return msg body, and X-Moonmq-Msg-Id header,
+		X-Moonmq-Headers header if msg has headers, traceparent header
+		if msg has trace context.
+		wait at most timeout milliseconds, or http_poll_timeout seconds if
+		not supplied, return 204 if no msg.
+		if ack is 1, msg is leased for http_lease_timeout seconds, and must be
+		acked with /msg/ack, or it will be pushed again after lease timeout.
+
+	POST /msg/ack?queue=xxx&msg_id=xxx
+		ack leased msg
+
+	POST /msg/nack?queue=xxx&msg_id=xxx
+		give up leased msg, it will be pushed again
+
+	batch api is in http_batch.go, streaming api is in http_sse.go and http_ws.go
+*/
+
+const (
+	msgIdHeader        = "X-Moonmq-Msg-Id"
+	routingKeyHeader   = "X-Moonmq-Routing-Key"
+	headersHeader      = "X-Moonmq-Headers"
+	leaseTimeoutHeader = "X-Moonmq-Lease-Timeout"
+)
+
+type msgLease struct {
+	ch *channel
+	t  *time.Timer
+}
+
 type MsgHandler struct {
+	sync.Mutex
+
 	app *App
+
+	leases map[string]*msgLease
 }
 
 func newMsgHandler(app *App) *MsgHandler {
@@ -17,6 +63,8 @@ func newMsgHandler(app *App) *MsgHandler {
 
 	h.app = app
 
+	h.leases = make(map[string]*msgLease)
+
 	return h
 }
 
@@ -34,7 +82,9 @@ func (h *MsgHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *MsgHandler) publishMsg(w http.ResponseWriter, r *http.Request) {
-	message, err := ioutil.ReadAll(r.Body)
+	//read one more byte to tell too large body
+	limit := int64(h.app.Config().MaxMessageSize) + 1
+	message, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -47,10 +97,35 @@ func (h *MsgHandler) publishMsg(w http.ResponseWriter, r *http.Request) {
 	if err := checkPublish(queue, routingKey, tp, message); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if err = h.app.checkMsgSize(message); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var headers map[string]string
+	if v := r.Header.Get(headersHeader); len(v) > 0 {
+		if err = json.Unmarshal([]byte(v), &headers); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s, %s", headersHeader, err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := r.Header.Get(proto.TraceparentHeader); len(v) > 0 {
+		if _, ok := headers[proto.TraceparentHeader]; !ok {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[proto.TraceparentHeader] = v
+		}
+	}
+
+	if h.app.flow.blocked(queue, false) && !h.app.flow.wait(queue, r.Context().Done()) {
+		//publisher has gone, msg is not saved
+		return
 	}
 
 	var m *msg
-	m, err = h.app.saveMsg(queue, routingKey, tp, message)
+	m, err = h.app.saveMsg(queue, routingKey, tp, headers, message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -62,24 +137,6 @@ func (h *MsgHandler) publishMsg(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(strconv.FormatInt(m.id, 10)))
 }
 
-type httpMsgPusher struct {
-	m chan *msg
-	e chan error
-}
-
-func (p *httpMsgPusher) Push(ch *channel, m *msg) error {
-	p.m <- m
-
-	e, ok := <-p.e
-	if e != nil {
-		return e
-	} else if !ok {
-		return fmt.Errorf("push invalid channel")
-	} else {
-		return nil
-	}
-}
-
 func (h *MsgHandler) getMsg(w http.ResponseWriter, r *http.Request) {
 	queue := r.FormValue("queue")
 	routingKey := r.FormValue("routing_key")
@@ -89,22 +146,129 @@ func (h *MsgHandler) getMsg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mc := make(chan *msg, 1)
-	ec := make(chan error, 1)
-	q := h.app.qs.Get(queue)
-	ch := newChannel(&httpMsgPusher{mc, ec}, q, routingKey, true)
-	defer ch.Close()
-
-	select {
-	case m := <-mc:
-		_, err := w.Write(m.body)
-		if err == nil && ch.noAck {
-			ch.Ack(m.id)
+	lease := (r.FormValue("ack") == "1")
+
+	timeout := time.Duration(h.app.Config().HttpPollTimeout) * time.Second
+	if v := r.FormValue("timeout"); len(v) > 0 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
 		}
+		timeout = time.Duration(n) * time.Millisecond
+	}
+
+	pusher := newGetMsgPusher()
+	q := h.app.qs.Get(queue)
 
-		ec <- err
-		close(ec)
-	case <-time.After(60 * time.Second):
+	//ack after writing msg, so msg is pushed again if writing failed
+	ch := newChannel(pusher, q, routingKey, false)
+
+	m := pusher.Wait(ch.q, timeout)
+	if m == nil {
+		ch.Close()
 		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set(msgIdHeader, strconv.FormatInt(m.id, 10))
+	w.Header().Set(routingKeyHeader, m.routingKey)
+	if len(m.headers) > 0 {
+		if buf, err := json.Marshal(m.headers); err == nil {
+			w.Header().Set(headersHeader, string(buf))
+		}
 	}
+	if v, ok := m.headers[proto.TraceparentHeader]; ok {
+		w.Header().Set(proto.TraceparentHeader, v)
+	}
+	if lease {
+		w.Header().Set(leaseTimeoutHeader, strconv.Itoa(h.app.Config().HttpLeaseTimeout))
+	}
+
+	if _, err := w.Write(m.body); err != nil {
+		ch.Close()
+		return
+	}
+
+	if lease {
+		h.lease(queue, m.id, ch)
+	} else {
+		ch.Ack(m.id)
+		ch.Close()
+	}
+}
+
+func leaseKey(queue string, msgId int64) string {
+	return fmt.Sprintf("%s:%d", queue, msgId)
+}
+
+func (h *MsgHandler) lease(queue string, msgId int64, ch *channel) {
+	key := leaseKey(queue, msgId)
+
+	l := new(msgLease)
+	l.ch = ch
+
+	h.Lock()
+	h.leases[key] = l
+	l.t = time.AfterFunc(time.Duration(h.app.Config().HttpLeaseTimeout)*time.Second, func() {
+		if h.popLease(key) == l {
+			l.ch.Close()
+		}
+	})
+	h.Unlock()
+}
+
+func (h *MsgHandler) popLease(key string) *msgLease {
+	h.Lock()
+	defer h.Unlock()
+
+	l, ok := h.leases[key]
+	if ok {
+		delete(h.leases, key)
+		l.t.Stop()
+	}
+
+	return l
+}
+
+func (h *MsgHandler) popRequestLease(w http.ResponseWriter, r *http.Request) (*msgLease, int64) {
+	if r.Method != "POST" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return nil, 0
+	}
+
+	queue := r.FormValue("queue")
+	msgId, err := strconv.ParseInt(r.FormValue("msg_id"), 10, 64)
+	if len(queue) == 0 || err != nil {
+		http.Error(w, "queue and msg_id must supplied", http.StatusBadRequest)
+		return nil, 0
+	}
+
+	l := h.popLease(leaseKey(queue, msgId))
+	if l == nil {
+		http.Error(w, "msg not leased or lease timeout", http.StatusNotFound)
+		return nil, 0
+	}
+
+	return l, msgId
+}
+
+func (h *MsgHandler) ackMsg(w http.ResponseWriter, r *http.Request) {
+	l, msgId := h.popRequestLease(w, r)
+	if l == nil {
+		return
+	}
+
+	l.ch.Ack(msgId)
+	l.ch.Close()
+}
+
+func (h *MsgHandler) nackMsg(w http.ResponseWriter, r *http.Request) {
+	l, _ := h.popRequestLease(w, r)
+	if l == nil {
+		return
+	}
+
+	//unbind a channel not acked makes queue push msg again
+	l.ch.Close()
 }
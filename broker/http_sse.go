@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	GET /msg/sse?queue=xxx&routing_key=xxx
+		consume msgs with no ack as server sent events, every event is
+
+		id: msg id
+		event: msg
+		data: msg json, same as http batch api
+
+		a comment line is sent every keepalive seconds, and a shutdown
+		event is sent before stream ends when broker is shutting down.
+*/
+
+type sseMsgPusher struct {
+	sync.Mutex
+
+	app *App
+
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	closed bool
+
+	//closed when write fails, handler returns then
+	failed chan struct{}
+}
+
+//write blocks at most write_timeout, a client not reading can't block
+//the queue goroutine waiting push done
+func (p *sseMsgPusher) write(buf []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return fmt.Errorf("push closed sse")
+	}
+
+	p.rc.SetWriteDeadline(time.Now().Add(p.app.Config().writeTimeoutDuration()))
+
+	_, err := p.w.Write(buf)
+	if err == nil {
+		err = p.rc.Flush()
+	}
+
+	if err != nil {
+		p.closed = true
+		close(p.failed)
+	}
+
+	return err
+}
+
+func (p *sseMsgPusher) Push(ch *channel, m *msg) error {
+	data, err := json.Marshal(newHttpMsg(m))
+	if err != nil {
+		return err
+	}
+
+	return p.write([]byte(fmt.Sprintf("id: %d\nevent: msg\ndata: %s\n\n", m.id, data)))
+}
+
+//writer can't be used after handler returns
+func (p *sseMsgPusher) close() {
+	p.Lock()
+	p.closed = true
+	p.Unlock()
+}
+
+func (h *MsgHandler) sseMsg(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	queue := r.FormValue("queue")
+	routingKey := r.FormValue("routing_key")
+
+	if err := checkBind(queue, routingKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	p := &sseMsgPusher{app: h.app, w: w, rc: http.NewResponseController(w), failed: make(chan struct{})}
+	defer p.close()
+
+	q := h.app.qs.Get(queue)
+	ch := newChannel(p, q, routingKey, true)
+	defer ch.Close()
+
+	//keepalive also finds closed client
+	t := time.NewTicker(h.app.Config().keepAliveDuration())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-p.failed:
+			return
+		case <-h.app.quit:
+			p.write([]byte("event: shutdown\ndata:\n\n"))
+			return
+		case <-t.C:
+			if err := p.write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	GET /msg/ws
+		consume msgs over websocket, every message is a json text
+
+		client sends:
+
+		{"action":"bind", "queue":"xxx", "routing_key":"xxx", "no_ack":true}
+		{"action":"ack", "queue":"xxx", "msg_id":1}
+		{"action":"unbind", "queue":"xxx"}, unbind all if queue is empty
+
+		broker replies bind_ok, unbind_ok or error for bind and unbind,
+		error for ack only if failed, and pushes msgs:
+
+		{"action":"bind_ok", "queue":"xxx"}
+		{"action":"unbind_ok", "queue":"xxx"}
+		{"action":"error", "queue":"xxx", "code":400, "message":"xxx"}
+		{"action":"push", "queue":"xxx", "msg":{msg json, same as http batch api}}
+
+		when broker is shutting down, it sends below and rejects bind,
+		msgs pushed before can still be acked until broker closes conn.
+
+		{"action":"shutdown", "queue":""}
+*/
+
+const (
+	wsBindAction     = "bind"
+	wsBindOKAction   = "bind_ok"
+	wsUnbindAction   = "unbind"
+	wsUnbindOKAction = "unbind_ok"
+	wsAckAction      = "ack"
+	wsPushAction     = "push"
+	wsErrorAction    = "error"
+	wsShutdownAction = "shutdown"
+)
+
+type wsRequest struct {
+	Action     string `json:"action"`
+	Queue      string `json:"queue"`
+	RoutingKey string `json:"routing_key"`
+	NoAck      bool   `json:"no_ack"`
+	MsgId      int64  `json:"msg_id"`
+}
+
+type wsReply struct {
+	Action  string   `json:"action"`
+	Queue   string   `json:"queue"`
+	Code    int      `json:"code,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Msg     *httpMsg `json:"msg,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+type wsConn struct {
+	sync.Mutex
+
+	app *App
+
+	ws *websocket.Conn
+
+	channels map[string]*channel
+}
+
+type wsMsgPusher struct {
+	c *wsConn
+}
+
+func (p *wsMsgPusher) Push(ch *channel, m *msg) error {
+	return p.c.write(&wsReply{Action: wsPushAction, Queue: ch.q.name, Msg: newHttpMsg(m)})
+}
+
+func (h *MsgHandler) wsMsg(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := new(wsConn)
+	c.app = h.app
+	c.ws = ws
+	c.channels = make(map[string]*channel)
+
+	c.run()
+}
+
+func (c *wsConn) write(reply *wsReply) error {
+	c.Lock()
+	defer c.Unlock()
+
+	//a client not reading can't block the queue goroutine waiting push done
+	c.ws.SetWriteDeadline(time.Now().Add(c.app.Config().writeTimeoutDuration()))
+	err := c.ws.WriteJSON(reply)
+	if err != nil {
+		c.ws.Close()
+	}
+
+	return err
+}
+
+func (c *wsConn) writeError(queue string, code int, message string) {
+	c.write(&wsReply{Action: wsErrorAction, Queue: queue, Code: code, Message: message})
+}
+
+func (c *wsConn) run() {
+	defer func() {
+		c.unbindAll()
+		c.ws.Close()
+	}()
+
+	keepAlive := c.app.Config().keepAliveDuration()
+
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		return nil
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		t := time.NewTicker(keepAlive)
+		defer t.Stop()
+
+		quit := c.app.quit
+		for {
+			select {
+			case <-quit:
+				quit = nil
+				c.write(&wsReply{Action: wsShutdownAction})
+			case <-c.app.closed:
+				c.ws.Close()
+				return
+			case <-t.C:
+				c.Lock()
+				err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.app.Config().writeTimeoutDuration()))
+				c.Unlock()
+				if err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+
+		_, buf, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req wsRequest
+		if err = json.Unmarshal(buf, &req); err != nil {
+			c.writeError("", http.StatusBadRequest, err.Error())
+			continue
+		}
+
+		switch req.Action {
+		case wsBindAction:
+			c.handleBind(&req)
+		case wsUnbindAction:
+			c.handleUnbind(&req)
+		case wsAckAction:
+			c.handleAck(&req)
+		default:
+			c.writeError(req.Queue, http.StatusBadRequest, "invalid action")
+		}
+	}
+}
+
+func (c *wsConn) handleBind(req *wsRequest) {
+	if err := checkBind(req.Queue, req.RoutingKey); err != nil {
+		c.writeError(req.Queue, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if c.app.isClosing() {
+		c.writeError(req.Queue, http.StatusServiceUnavailable, "broker is shutting down")
+		return
+	}
+
+	ch, ok := c.channels[req.Queue]
+	if !ok {
+		q := c.app.qs.Get(req.Queue)
+		ch = newChannel(&wsMsgPusher{c}, q, req.RoutingKey, req.NoAck)
+		c.channels[req.Queue] = ch
+	} else {
+		ch.Reset(req.RoutingKey, req.NoAck)
+	}
+
+	c.write(&wsReply{Action: wsBindOKAction, Queue: req.Queue})
+}
+
+func (c *wsConn) unbindAll() {
+	for _, ch := range c.channels {
+		ch.Close()
+	}
+
+	c.channels = map[string]*channel{}
+}
+
+func (c *wsConn) handleUnbind(req *wsRequest) {
+	if len(req.Queue) == 0 {
+		c.unbindAll()
+	} else if ch, ok := c.channels[req.Queue]; ok {
+		delete(c.channels, req.Queue)
+		ch.Close()
+	}
+
+	c.write(&wsReply{Action: wsUnbindOKAction, Queue: req.Queue})
+}
+
+func (c *wsConn) handleAck(req *wsRequest) {
+	ch, ok := c.channels[req.Queue]
+	if !ok {
+		c.writeError(req.Queue, http.StatusForbidden, "invalid queue")
+		return
+	}
+
+	ch.Ack(req.MsgId)
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"github.com/siddontang/moonmq/proto"
+)
+
+//QueueMsg is a msg stored in a queue, msg pushed is kept until acked
+type QueueMsg struct {
+	ID         int64
+	RoutingKey string
+	PubType    string
+	Headers    map[string]string
+	Body       []byte
+}
+
+//QueueLen returns msgs stored in queue
+func (app *App) QueueLen(queue string) (int, error) {
+	return app.ms.Len(queue)
+}
+
+//PeekQueue returns at most n head msgs of queue without consuming them
+func (app *App) PeekQueue(queue string, n int) ([]*QueueMsg, error) {
+	ms, err := app.ms.Peek(queue, n)
+	if err != nil {
+		return nil, err
+	}
+
+	qms := make([]*QueueMsg, 0, len(ms))
+	for _, m := range ms {
+		pubType := proto.DirectPubTypeStr
+		if m.pubType == proto.FanoutType {
+			pubType = proto.FanoutPubTypeStr
+		}
+
+		qms = append(qms, &QueueMsg{m.id, m.routingKey, pubType, m.headers, m.body})
+	}
+
+	return qms, nil
+}
@@ -13,6 +13,7 @@ func (d MemStoreDriver) Open(jsonConfig json.RawMessage) (Store, error) {
 	return newMemStore()
 }
 
+//MemStore keeps msgs in memory as published, it has no at rest compression
 type MemStore struct {
 	sync.Mutex
 
@@ -146,6 +147,33 @@ func (s *MemStore) Front(queue string) (*msg, error) {
 	}
 }
 
+func (s *MemStore) Peek(queue string, n int) ([]*msg, error) {
+	key := s.key(queue)
+
+	s.Lock()
+	defer s.Unlock()
+
+	q := s.msgs[key]
+	if n > len(q) {
+		n = len(q)
+	}
+
+	ms := make([]*msg, n)
+	copy(ms, q[:n])
+
+	return ms, nil
+}
+
+func (s *MemStore) Purge(queue string) error {
+	key := s.key(queue)
+
+	s.Lock()
+	delete(s.msgs, key)
+	s.Unlock()
+
+	return nil
+}
+
 func init() {
 	RegisterStore("mem", MemStoreDriver{})
 }
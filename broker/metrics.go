@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	metrics api
+
+	GET /metrics
+		return metrics in prometheus text format
+
+	counters are process wide, queue depth is read from store at scrape time
+*/
+
+type counter struct {
+	v int64
+}
+
+func (c *counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+func (c *counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+//upper bounds in seconds
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	sync.Mutex
+
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	h := new(histogram)
+	h.counts = make([]int64, len(latencyBuckets))
+	return h
+}
+
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	h.Unlock()
+}
+
+type metrics struct {
+	publishes    counter
+	pushes       counter
+	acks         counter
+	redeliveries counter
+	expirations  counter
+	discards     counter
+	conns        counter
+
+	//key is store method name, created in newMetrics, never changed
+	storeLatency map[string]*histogram
+}
+
+var storeMethods = []string{"generate_id", "save", "delete", "pop", "front", "len", "peek", "purge"}
+
+func newMetrics() *metrics {
+	m := new(metrics)
+
+	m.storeLatency = make(map[string]*histogram, len(storeMethods))
+	for _, name := range storeMethods {
+		m.storeLatency[name] = newHistogram()
+	}
+
+	return m
+}
+
+func (m *metrics) observeStore(method string, start time.Time) {
+	m.storeLatency[method].Observe(time.Now().Sub(start).Seconds())
+}
+
+func writeMetricHead(buf *bytes.Buffer, name string, tp string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, tp)
+}
+
+func writeCounter(buf *bytes.Buffer, name string, help string, v int64) {
+	writeMetricHead(buf, name, "counter", help)
+	fmt.Fprintf(buf, "%s %d\n", name, v)
+}
+
+func (m *metrics) writeStoreLatency(buf *bytes.Buffer) {
+	name := "moonmq_store_duration_seconds"
+	writeMetricHead(buf, name, "histogram", "Latency of store methods.")
+
+	for _, method := range storeMethods {
+		h := m.storeLatency[method]
+
+		h.Lock()
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(buf, "%s_bucket{method=\"%s\",le=\"%g\"} %d\n", name, method, b, h.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{method=\"%s\",le=\"+Inf\"} %d\n", name, method, h.count)
+		fmt.Fprintf(buf, "%s_sum{method=\"%s\"} %g\n", name, method, h.sum)
+		fmt.Fprintf(buf, "%s_count{method=\"%s\"} %d\n", name, method, h.count)
+		h.Unlock()
+	}
+}
+
+func (app *App) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := app.metrics
+
+	var buf bytes.Buffer
+
+	writeCounter(&buf, "moonmq_publishes_total", "Msgs published.", m.publishes.Value())
+	writeCounter(&buf, "moonmq_pushes_total", "Msgs delivered to consumers, pushed or pulled.", m.pushes.Value())
+	writeCounter(&buf, "moonmq_acks_total", "Msgs acked.", m.acks.Value())
+	writeCounter(&buf, "moonmq_redeliveries_total", "Msgs delivered again after not being acked.", m.redeliveries.Value())
+	writeCounter(&buf, "moonmq_expirations_total", "Msgs deleted after msg_timeout.", m.expirations.Value())
+	writeCounter(&buf, "moonmq_discards_total", "Msgs deleted without delivery, no matched channel or queue full.", m.discards.Value())
+	writeCounter(&buf, "moonmq_connections_total", "Tcp connections accepted.", m.conns.Value())
+
+	writeMetricHead(&buf, "moonmq_connections", "gauge", "Tcp connections open now.")
+	fmt.Fprintf(&buf, "moonmq_connections %d\n", len(app.listConns()))
+
+	qs := app.qs.List()
+	writeMetricHead(&buf, "moonmq_queues", "gauge", "Queues in memory.")
+	fmt.Fprintf(&buf, "moonmq_queues %d\n", len(qs))
+
+	depths := make(map[string]int, len(qs))
+	names := make([]string, 0, len(qs))
+	for _, rq := range qs {
+		if n, err := app.ms.Len(rq.name); err == nil {
+			depths[rq.name] = n
+			names = append(names, rq.name)
+		}
+	}
+	sort.Strings(names)
+
+	writeMetricHead(&buf, "moonmq_queue_depth", "gauge", "Msgs stored in queue.")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "moonmq_queue_depth{queue=%q} %d\n", name, depths[name])
+	}
+
+	m.writeStoreLatency(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+//meteredStore records latency of every Store method
+type meteredStore struct {
+	s Store
+	m *metrics
+}
+
+func newMeteredStore(s Store, m *metrics) *meteredStore {
+	return &meteredStore{s, m}
+}
+
+func (s *meteredStore) Close() error {
+	return s.s.Close()
+}
+
+func (s *meteredStore) GenerateID() (int64, error) {
+	defer s.m.observeStore("generate_id", time.Now())
+	return s.s.GenerateID()
+}
+
+func (s *meteredStore) Save(queue string, m *msg) error {
+	defer s.m.observeStore("save", time.Now())
+	return s.s.Save(queue, m)
+}
+
+func (s *meteredStore) Delete(queue string, msgId int64) error {
+	defer s.m.observeStore("delete", time.Now())
+	return s.s.Delete(queue, msgId)
+}
+
+func (s *meteredStore) Pop(queue string) error {
+	defer s.m.observeStore("pop", time.Now())
+	return s.s.Pop(queue)
+}
+
+func (s *meteredStore) Front(queue string) (*msg, error) {
+	defer s.m.observeStore("front", time.Now())
+	return s.s.Front(queue)
+}
+
+func (s *meteredStore) Len(queue string) (int, error) {
+	defer s.m.observeStore("len", time.Now())
+	return s.s.Len(queue)
+}
+
+func (s *meteredStore) Peek(queue string, n int) ([]*msg, error) {
+	defer s.m.observeStore("peek", time.Now())
+	return s.s.Peek(queue, n)
+}
+
+func (s *meteredStore) Purge(queue string) error {
+	defer s.m.observeStore("purge", time.Now())
+	return s.s.Purge(queue)
+}
@@ -2,15 +2,35 @@ package broker
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"github.com/siddontang/moonmq/proto"
 	"time"
 )
 
+/*
+	msg encode format is
+
+	|length(4 bytes)|id(8 bytes)|ctime(8 bytes)|flag(1 byte)|key length(1 byte)|routing key|[headers]|body|
+
+	flag low 3 bits is pub type, bit 3 is set if msg has headers,
+	high 4 bits is compressor id of body, 0 means not compressed
+
+	headers is |headers length(4 bytes)|headers json|
+*/
+
+const (
+	msgPubTypeMask   = 0x07
+	msgHeadersFlag   = 0x08
+	msgCompressShift = 4
+)
+
 type msg struct {
 	id         int64
 	ctime      int64
 	pubType    uint8
 	routingKey string
+	headers    map[string]string
 	body       []byte
 }
 
@@ -27,7 +47,38 @@ func newMsg(id int64, pubType uint8, routingKey string, body []byte) *msg {
 }
 
 func (m *msg) Encode() ([]byte, error) {
-	lenBuf := 4 + 8 + 8 + 1 + 1 + len(m.routingKey) + len(m.body)
+	return m.encode(0, m.body)
+}
+
+//EncodeCompress compresses body with c, if it's no smaller, leave it as is
+func (m *msg) EncodeCompress(c proto.Compressor) ([]byte, error) {
+	if c == nil {
+		return m.Encode()
+	}
+
+	body, err := c.Compress(m.body)
+	if err != nil {
+		return nil, err
+	} else if len(body) >= len(m.body) {
+		return m.Encode()
+	}
+
+	return m.encode(c.ID(), body)
+}
+
+func (m *msg) encode(compressId uint8, body []byte) ([]byte, error) {
+	var headers []byte
+	if len(m.headers) > 0 {
+		var err error
+		if headers, err = json.Marshal(m.headers); err != nil {
+			return nil, err
+		}
+	}
+
+	lenBuf := 4 + 8 + 8 + 1 + 1 + len(m.routingKey) + len(body)
+	if headers != nil {
+		lenBuf += 4 + len(headers)
+	}
 	buf := make([]byte, lenBuf)
 
 	pos := 0
@@ -41,7 +92,10 @@ func (m *msg) Encode() ([]byte, error) {
 	binary.BigEndian.PutUint64(buf[pos:], uint64(m.ctime))
 	pos += 8
 
-	buf[pos] = byte(m.pubType)
+	buf[pos] = byte(m.pubType&msgPubTypeMask) | byte(compressId<<msgCompressShift)
+	if headers != nil {
+		buf[pos] |= msgHeadersFlag
+	}
 	pos++
 
 	buf[pos] = byte(len(m.routingKey))
@@ -50,12 +104,20 @@ func (m *msg) Encode() ([]byte, error) {
 	copy(buf[pos:], m.routingKey)
 	pos += len(m.routingKey)
 
-	copy(buf[pos:], m.body)
+	if headers != nil {
+		binary.BigEndian.PutUint32(buf[pos:], uint32(len(headers)))
+		pos += 4
+
+		copy(buf[pos:], headers)
+		pos += len(headers)
+	}
+
+	copy(buf[pos:], body)
 	return buf, nil
 }
 
 func (m *msg) Decode(buf []byte) error {
-	if len(buf) < 4 {
+	if len(buf) < 4+8+8+1+1 {
 		return fmt.Errorf("buf too short")
 	}
 
@@ -72,15 +134,53 @@ func (m *msg) Decode(buf []byte) error {
 
 	m.ctime = int64(binary.BigEndian.Uint64(buf[pos : pos+8]))
 	pos += 8
-	m.pubType = uint8(buf[pos])
+
+	flag := uint8(buf[pos])
+	m.pubType = flag & msgPubTypeMask
+	compressId := flag >> msgCompressShift
 	pos++
 
 	keyLen := int(uint8(buf[pos]))
 	pos++
+	if pos+keyLen > len(buf) {
+		return fmt.Errorf("invalid routing key len")
+	}
+
 	m.routingKey = string(buf[pos : pos+keyLen])
 	pos += keyLen
 
+	if flag&msgHeadersFlag != 0 {
+		if pos+4 > len(buf) {
+			return fmt.Errorf("invalid headers len")
+		}
+
+		headersLen := int(binary.BigEndian.Uint32(buf[pos:]))
+		pos += 4
+
+		if pos+headersLen > len(buf) {
+			return fmt.Errorf("invalid headers len")
+		}
+
+		if err := json.Unmarshal(buf[pos:pos+headersLen], &m.headers); err != nil {
+			return err
+		}
+		pos += headersLen
+	}
+
 	m.body = buf[pos:]
 
+	if compressId != 0 {
+		c := proto.GetCompressorByID(compressId)
+		if c == nil {
+			return fmt.Errorf("invalid compressor id %d", compressId)
+		}
+
+		body, err := c.Decompress(m.body, 0)
+		if err != nil {
+			return err
+		}
+		m.body = body
+	}
+
 	return nil
 }
@@ -1,6 +1,8 @@
 package broker
 
 import (
+	"bytes"
+	"github.com/siddontang/moonmq/proto"
 	"reflect"
 	"testing"
 )
@@ -57,3 +59,27 @@ func TestMsgStore(t *testing.T) {
 		t.Fatal("delete failed")
 	}
 }
+
+func TestMsgCompress(t *testing.T) {
+	m := newMsg(1, 1, "abc", bytes.Repeat([]byte("hello world"), 100))
+	m.headers = map[string]string{"reply_to": "abc"}
+
+	for _, name := range []string{proto.GzipCompression, proto.SnappyCompression, proto.ZstdCompression} {
+		buf, err := m.EncodeCompress(proto.GetCompressor(name))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(buf) >= len(m.body) {
+			t.Fatal(name, "not compressed")
+		}
+
+		m2 := new(msg)
+
+		if err := m2.Decode(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatal(name, "not equal")
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"container/list"
 	"fmt"
 	"github.com/siddontang/moonmq/proto"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -30,8 +32,21 @@ type queue struct {
 
 	ch chan func()
 
+	//closed when queue goroutine exits, requests fail with errQueueDeleted then
+	done chan struct{}
+
 	waitingAcks map[*channel]struct{}
 	lastPushId  int64
+
+	//last msg pushed successfully, same msg pushed again is a redelivery
+	lastDeliveredId int64
+	//trace context of msg waiting ack, parent of ack span
+	lastPushTrace proto.TraceContext
+
+	//last push is acked by no ack channel, push next after queued funcs
+	repush bool
+
+	closed bool
 }
 
 func newQueue(qs *queues, name string) *queue {
@@ -47,10 +62,12 @@ func newQueue(qs *queues, name string) *queue {
 	rq.channels = list.New()
 
 	rq.lastPushId = -1
+	rq.lastDeliveredId = -1
 
 	rq.waitingAcks = make(map[*channel]struct{})
 
 	rq.ch = make(chan func(), 32)
+	rq.done = make(chan struct{})
 
 	go rq.run()
 
@@ -58,16 +75,37 @@ func newQueue(qs *queues, name string) *queue {
 }
 
 func (rq *queue) run() {
+	defer close(rq.done)
+
 	for {
+		if rq.repush {
+			select {
+			case f := <-rq.ch:
+				f()
+			default:
+				rq.repush = false
+				rq.push()
+			}
+
+			if rq.closed {
+				return
+			}
+			continue
+		}
+
 		select {
 		case f := <-rq.ch:
 			f()
+
+			if rq.closed {
+				return
+			}
 		case <-time.After(5 * time.Minute):
 			if rq.channels.Len() == 0 {
 				m, _ := rq.getMsg()
 				if m == nil {
 					//no conn, and no msg
-					rq.qs.Delete(rq.name)
+					rq.qs.Delete(rq)
 					return
 				}
 			}
@@ -75,7 +113,128 @@ func (rq *queue) run() {
 	}
 }
 
-func (rq *queue) Bind(c *channel) {
+var errQueueDeleted = fmt.Errorf("queue has been deleted")
+
+//do queues f to run in queue goroutine without waiting it
+func (rq *queue) do(f func()) error {
+	select {
+	case rq.ch <- f:
+		return nil
+	case <-rq.done:
+		return errQueueDeleted
+	}
+}
+
+//call runs f in queue goroutine and waits it done, f is not run if queue
+//is deleted before it
+func (rq *queue) call(f func()) error {
+	fdone := make(chan struct{})
+	if err := rq.do(func() {
+		f()
+		close(fdone)
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case <-fdone:
+		return nil
+	case <-rq.done:
+		//f may be the one deleting queue
+		select {
+		case <-fdone:
+			return nil
+		default:
+			return errQueueDeleted
+		}
+	}
+}
+
+type channelInfo struct {
+	Queue      string `json:"queue"`
+	RoutingKey string `json:"routing_key"`
+	NoAck      bool   `json:"no_ack"`
+}
+
+type queueInfo struct {
+	Name string `json:"name"`
+
+	Depth int `json:"depth"`
+
+	//msg pushed and waiting ack, -1 if none
+	WaitingAckId int64 `json:"waiting_ack_id"`
+
+	Channels []*channelInfo `json:"channels"`
+}
+
+func (rq *queue) Info() (*queueInfo, error) {
+	info := new(queueInfo)
+	f := func() {
+		info.Name = rq.name
+		info.WaitingAckId = rq.lastPushId
+		info.Channels = make([]*channelInfo, 0, rq.channels.Len())
+
+		for e := rq.channels.Front(); e != nil; e = e.Next() {
+			info.Channels = append(info.Channels, e.Value.(*channel).Info())
+		}
+	}
+
+	if err := rq.call(f); err != nil {
+		return nil, err
+	}
+
+	var err error
+	info.Depth, err = rq.store.Len(rq.name)
+
+	return info, err
+}
+
+//Purge deletes all msgs, msg waiting ack is not pushed again
+func (rq *queue) Purge() error {
+	var err error
+	f := func() {
+		rq.waitingAcks = map[*channel]struct{}{}
+		rq.lastPushId = -1
+
+		err = rq.store.Purge(rq.name)
+	}
+
+	if cerr := rq.call(f); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+var errQueueBound = fmt.Errorf("queue has bound channels")
+
+//Delete purges and deletes queue, only if no channel bound
+func (rq *queue) Delete() error {
+	var err error
+	f := func() {
+		if rq.channels.Len() > 0 {
+			err = errQueueBound
+			return
+		}
+
+		if err = rq.store.Purge(rq.name); err != nil {
+			return
+		}
+
+		rq.qs.Delete(rq)
+		rq.closed = true
+	}
+
+	if cerr := rq.call(f); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+//Bind fails with errQueueDeleted if queue is deleted before binding,
+//a new queue must be got then
+func (rq *queue) Bind(c *channel) error {
 	f := func() {
 		for e := rq.channels.Front(); e != nil; e = e.Next() {
 			if e.Value.(*channel) == c {
@@ -89,7 +248,7 @@ func (rq *queue) Bind(c *channel) {
 		rq.push()
 	}
 
-	rq.ch <- f
+	return rq.call(f)
 }
 
 func (rq *queue) Unbind(c *channel) {
@@ -118,7 +277,7 @@ func (rq *queue) Unbind(c *channel) {
 		}
 	}
 
-	rq.ch <- f
+	rq.do(f)
 }
 
 func (rq *queue) Ack(msgId int64) {
@@ -127,23 +286,124 @@ func (rq *queue) Ack(msgId int64) {
 			return
 		}
 
-		rq.store.Delete(rq.name, msgId)
+		rq.ack(msgId)
+		rq.push()
+	}
+
+	rq.do(f)
+}
+
+func (rq *queue) ack(msgId int64) {
+	rq.store.Delete(rq.name, msgId)
+	rq.app.metrics.acks.Inc()
+
+	rq.endAckSpan(msgId, "ack")
+
+	rq.waitingAcks = map[*channel]struct{}{}
+	rq.lastPushId = -1
+}
+
+//Nack gives up pushed msg for channel c. if requeue, msg is pushed again
+//after all channels waiting it give up, direct msg goes to the next
+//matched channel, otherwise msg is discarded
+func (rq *queue) Nack(c *channel, msgId int64, requeue bool) {
+	f := func() {
+		if msgId != rq.lastPushId {
+			return
+		}
+
+		if _, ok := rq.waitingAcks[c]; !ok {
+			return
+		}
+
+		if requeue {
+			rq.endAckSpan(msgId, "nack")
+
+			delete(rq.waitingAcks, c)
+			if len(rq.waitingAcks) > 0 {
+				return
+			}
+		} else {
+			rq.store.Delete(rq.name, msgId)
+			rq.app.metrics.discards.Inc()
+
+			rq.endAckSpan(msgId, "reject")
+
+			rq.waitingAcks = map[*channel]struct{}{}
+		}
 
-		rq.waitingAcks = map[*channel]struct{}{}
 		rq.lastPushId = -1
 
 		rq.push()
 	}
 
-	rq.ch <- f
+	rq.do(f)
 }
 
+//Push is dropped if queue is deleted, msg is kept in store and pushed by
+//a new queue with same name
 func (rq *queue) Push(m *msg) {
 	f := func() {
 		rq.push()
 	}
 
-	rq.ch <- f
+	rq.do(f)
+}
+
+//Inflight returns whether a pushed msg is waiting ack
+func (rq *queue) Inflight() bool {
+	var inflight bool
+	f := func() {
+		inflight = rq.lastPushId != -1
+	}
+
+	rq.call(f)
+
+	return inflight
+}
+
+//Sync waits until all queued operations before it are done
+func (rq *queue) Sync() {
+	rq.call(func() {})
+}
+
+//Drain deletes and returns at most count msgs which can be delivered to
+//routingKey now, used by no ack pull consumers, it returns nothing if
+//a msg is waiting ack
+func (rq *queue) Drain(routingKey string, count int) []*msg {
+	var ms []*msg
+	f := func() {
+		ms = rq.drain(routingKey, count)
+	}
+
+	rq.call(f)
+
+	return ms
+}
+
+func (rq *queue) drain(routingKey string, count int) []*msg {
+	var ms []*msg
+	for len(ms) < count && rq.lastPushId == -1 && !rq.app.isClosing() {
+		m, err := rq.getMsg()
+		if err != nil || m == nil {
+			break
+		}
+
+		//direct msg not match, leave it to push rule
+		if m.pubType != proto.FanoutType && m.routingKey != routingKey {
+			break
+		}
+
+		if err = rq.store.Delete(rq.name, m.id); err != nil {
+			break
+		}
+
+		ms = append(ms, m)
+	}
+
+	rq.app.metrics.pushes.Add(int64(len(ms)))
+
+	return ms
 }
 
 func (rq *queue) getMsg() (*msg, error) {
@@ -157,15 +417,18 @@ func (rq *queue) getMsg() (*msg, error) {
 			return nil, nil
 		}
 
-		if rq.app.cfg.MessageTimeout > 0 {
+		if rq.app.Config().MessageTimeout > 0 {
 			now := time.Now().Unix()
-			if m.ctime+int64(rq.app.cfg.MessageTimeout) < now {
+			if m.ctime+int64(rq.app.Config().MessageTimeout) < now {
 				if err := rq.store.Delete(rq.name, m.id); err != nil {
 					return nil, err
 				}
+				rq.app.metrics.expirations.Inc()
 			} else {
 				break
 			}
+		} else {
+			break
 		}
 	}
 
@@ -177,6 +440,11 @@ func (rq *queue) push() {
 		return
 	}
 
+	//msgs are kept in store when shutting down
+	if rq.app.isClosing() {
+		return
+	}
+
 	if rq.channels.Len() == 0 {
 		return
 	}
@@ -188,25 +456,69 @@ func (rq *queue) push() {
 		return
 	}
 
+	route := rq.app.startSpan(SpanRoute, msgTrace(m), msgAttrs(rq.name, m))
+	if m.id == rq.lastDeliveredId {
+		route.SetAttribute("redelivery", "1")
+	}
+
+	var c *channel
 	switch m.pubType {
 	case proto.FanoutType:
-		err = rq.pushFanout(m)
+		c, err = rq.pushFanout(m, route)
 	default:
-		err = rq.pushDirect(m)
+		c, err = rq.pushDirect(m, route)
 	}
 
+	route.End(err)
+
 	if err == nil {
+		if m.id == rq.lastDeliveredId {
+			rq.app.metrics.redeliveries.Inc()
+		}
+
 		rq.lastPushId = m.id
+		rq.lastDeliveredId = m.id
+		rq.lastPushTrace = msgTrace(m)
+
+		//ack here, pusher acking it would wait queue goroutine which waits
+		//push done. push next in run, a long queue doesn't recurse then
+		if c.noAck {
+			rq.ack(m.id)
+			rq.repush = true
+		}
 	}
 }
 
-func (rq *queue) pushMsg(done chan bool, m *msg, c *channel) {
+func (rq *queue) endAckSpan(msgId int64, result string) {
+	span := rq.app.startSpan(SpanAck, rq.lastPushTrace, map[string]string{
+		"queue":  rq.name,
+		"msg_id": strconv.FormatInt(msgId, 10),
+		"result": result,
+	})
+	span.End(nil)
+}
+
+//pushMsg pushes m with deliver span, consumer gets its trace context,
+//done gets c if pushed, otherwise nil
+func (rq *queue) pushMsg(done chan *channel, m *msg, c *channel, route Span) {
 	go func() {
-		if err := c.Push(m); err == nil {
+		span := rq.app.startSpan(SpanDeliver, route.Context(), msgAttrs(rq.name, m))
+
+		if headers, ok := withTrace(m.headers, span); ok {
+			dm := *m
+			dm.headers = headers
+			m = &dm
+		}
+
+		err := c.Push(m)
+		span.End(err)
+
+		if err == nil {
 			//push suc
-			done <- true
+			rq.app.metrics.pushes.Inc()
+			done <- c
 		} else {
-			done <- false
+			done <- nil
 		}
 	}()
 }
@@ -219,7 +531,7 @@ func (rq *queue) match(m *msg, c *channel) bool {
 	return pubKey == subKey
 }
 
-func (rq *queue) pushDirect(m *msg) error {
+func (rq *queue) pushDirect(m *msg, route Span) (*channel, error) {
 	var c *channel = nil
 	for e := rq.channels.Front(); e != nil; e = e.Next() {
 		ch := e.Value.(*channel)
@@ -236,46 +548,43 @@ func (rq *queue) pushDirect(m *msg) error {
 	if c == nil {
 		//no channel match, discard msg and push next
 		rq.store.Delete(rq.name, m.id)
+		rq.app.metrics.discards.Inc()
 
-		f := func() {
-			rq.push()
-		}
-
-		rq.ch <- f
-		return fmt.Errorf("discard msg")
+		rq.repush = true
+		return nil, fmt.Errorf("discard msg")
 	}
 
 	rq.waitingAcks[c] = struct{}{}
 
-	done := make(chan bool, 1)
+	done := make(chan *channel, 1)
 
-	rq.pushMsg(done, m, c)
+	rq.pushMsg(done, m, c, route)
 
-	if r := <-done; r == true {
-		return nil
+	if c = <-done; c != nil {
+		return c, nil
 	} else {
-		return fmt.Errorf("push direct error")
+		return nil, fmt.Errorf("push direct error")
 	}
 }
 
-func (rq *queue) pushFanout(m *msg) error {
-	done := make(chan bool, rq.channels.Len())
+//pushFanout returns the first channel pushed
+func (rq *queue) pushFanout(m *msg, route Span) (*channel, error) {
+	done := make(chan *channel, rq.channels.Len())
 
 	for e := rq.channels.Front(); e != nil; e = e.Next() {
 		c := e.Value.(*channel)
 		rq.waitingAcks[c] = struct{}{}
 
-		rq.pushMsg(done, m, c)
+		rq.pushMsg(done, m, c, route)
 	}
 
 	for i := 0; i < rq.channels.Len(); i++ {
-		r := <-done
-		if r == true {
-			return nil
+		if c := <-done; c != nil {
+			return c, nil
 		}
 	}
 
-	return fmt.Errorf("push fanout error")
+	return nil, fmt.Errorf("push fanout error")
 }
 
 type queues struct {
@@ -320,8 +629,39 @@ func (qs *queues) Getx(name string) *queue {
 
 }
 
-func (qs *queues) Delete(name string) {
+//a new queue with same name may have been created
+func (qs *queues) Delete(rq *queue) {
 	qs.Lock()
-	delete(qs.qs, name)
+	if qs.qs[rq.name] == rq {
+		delete(qs.qs, rq.name)
+	}
 	qs.Unlock()
 }
+
+//Close stops all queue goroutines, must be called after all conns closed
+func (qs *queues) Close() {
+	for _, rq := range qs.List() {
+		rq.do(func() {
+			rq.closed = true
+		})
+	}
+}
+
+func (qs *queues) List() []*queue {
+	qs.RLock()
+	l := make([]*queue, 0, len(qs.qs))
+	for _, rq := range qs.qs {
+		l = append(l, rq)
+	}
+	qs.RUnlock()
+
+	sort.Sort(queueSlice(l))
+
+	return l
+}
+
+type queueSlice []*queue
+
+func (s queueSlice) Len() int           { return len(s) }
+func (s queueSlice) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s queueSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"github.com/siddontang/moonmq/proto"
 	"strings"
 )
 
@@ -13,6 +14,10 @@ type RedisStoreConfig struct {
 	Password  string `json:"password"`
 	IdleConns int    `json:"idle_conns"`
 	KeyPrefix string `json:"key_prefix"`
+
+	//compress msg body at rest, gzip, snappy or zstd, empty for none.
+	//only redis store compresses at rest, mem store keeps msgs as published
+	Compression string `json:"compression"`
 }
 
 type RedisStore struct {
@@ -21,6 +26,8 @@ type RedisStore struct {
 	cfg *RedisStoreConfig
 
 	keyPrefix string
+
+	compressor proto.Compressor
 }
 
 type RedisStoreDriver struct {
@@ -43,6 +50,12 @@ func newRedisStore(jsonConfig json.RawMessage) (*RedisStore, error) {
 	s.cfg = cfg
 	s.keyPrefix = cfg.KeyPrefix
 
+	if len(cfg.Compression) > 0 {
+		if s.compressor = proto.GetCompressor(cfg.Compression); s.compressor == nil {
+			return nil, fmt.Errorf("invalid compression %s", cfg.Compression)
+		}
+	}
+
 	f := func() (redis.Conn, error) {
 		n := "tcp"
 		if strings.Contains(cfg.Addr, "/") {
@@ -97,10 +110,13 @@ func (s *RedisStore) GenerateID() (int64, error) {
 func (s *RedisStore) Save(queue string, m *msg) error {
 	key := s.key(queue)
 
-	buf, _ := m.Encode()
+	buf, err := m.EncodeCompress(s.compressor)
+	if err != nil {
+		return err
+	}
 
 	c := s.redis.Get()
-	_, err := c.Do("ZADD", key, m.id, buf)
+	_, err = c.Do("ZADD", key, m.id, buf)
 	c.Close()
 
 	return err
@@ -133,6 +149,42 @@ func (s *RedisStore) Len(queue string) (int, error) {
 	return n, err
 }
 
+func (s *RedisStore) Peek(queue string, n int) ([]*msg, error) {
+	if n <= 0 {
+		return []*msg{}, nil
+	}
+
+	key := s.key(queue)
+	c := s.redis.Get()
+
+	vs, err := redis.Values(c.Do("ZRANGE", key, 0, n-1))
+	c.Close()
+
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	ms := make([]*msg, 0, len(vs))
+	for _, v := range vs {
+		m := new(msg)
+		if err = m.Decode(v.([]byte)); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
+
+func (s *RedisStore) Purge(queue string) error {
+	key := s.key(queue)
+	c := s.redis.Get()
+	_, err := c.Do("DEL", key)
+	c.Close()
+
+	return err
+}
+
 func (s *RedisStore) Front(queue string) (*msg, error) {
 	key := s.key(queue)
 	c := s.redis.Get()
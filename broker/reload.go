@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/siddontang/go-log/log"
+	"reflect"
+	"strings"
+)
+
+/*
+	hot config reload
+
+	most settings are read from app.Config() every time they are used, so
+	replacing config applies them live:
+
+	keepalive, write_timeout, max_msg_size, msg_timeout, max_queue_size,
+	http_poll_timeout, http_lease_timeout, compress_threshold, flow_*,
+	log_level
+
+	below need a restart, they are kept as running values after reload:
+
+	version, addr, http_addr, store, store_config, admin_password
+
+	compress_threshold only affects conns handshaked after reload.
+*/
+
+var restartConfigs = map[string]bool{
+	"version":      true,
+	"addr":         true,
+	"http_addr":    true,
+	"store":        true,
+	"store_config": true,
+
+	"admin_password": true,
+}
+
+type ReloadResult struct {
+	//changed settings applied live
+	Applied []string `json:"applied"`
+
+	//changed settings ignored until restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+func applyLogLevel(cfg *Config) {
+	if len(cfg.LogLevel) > 0 {
+		log.SetLevelByName(cfg.LogLevel)
+	} else {
+		log.SetLevelByName("info")
+	}
+}
+
+func configEqual(a reflect.Value, b reflect.Value) bool {
+	if ra, ok := a.Interface().(json.RawMessage); ok {
+		rb := b.Interface().(json.RawMessage)
+
+		var ba, bb bytes.Buffer
+		if json.Compact(&ba, ra) == nil && json.Compact(&bb, rb) == nil {
+			return bytes.Equal(ba.Bytes(), bb.Bytes())
+		}
+	}
+
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+//Reload replaces config with cfg, settings need restart keep running values
+func (app *App) Reload(cfg *Config) (*ReloadResult, error) {
+	if err := cfg.validateKeepAlive(); err != nil {
+		return nil, err
+	}
+
+	app.reloadLock.Lock()
+	defer app.reloadLock.Unlock()
+
+	old := app.Config()
+
+	r := new(ReloadResult)
+	r.Applied = []string{}
+	r.RestartRequired = []string{}
+
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(cfg).Elem()
+	t := ov.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+
+		if configEqual(ov.Field(i), nv.Field(i)) {
+			continue
+		}
+
+		if restartConfigs[name] {
+			r.RestartRequired = append(r.RestartRequired, name)
+			nv.Field(i).Set(ov.Field(i))
+		} else {
+			r.Applied = append(r.Applied, name)
+		}
+	}
+
+	app.cfg.Store(cfg)
+
+	applyLogLevel(cfg)
+
+	log.Infof("reload config, applied %v, restart required %v", r.Applied, r.RestartRequired)
+
+	return r, nil
+}
+
+//ReloadFile reloads config file app is created with
+func (app *App) ReloadFile() (*ReloadResult, error) {
+	if len(app.configFile) == 0 {
+		return nil, fmt.Errorf("app is not created from config file")
+	}
+
+	cfg, err := parseConfigFile(app.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.Reload(cfg)
+}
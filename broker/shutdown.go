@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"context"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/moonmq/proto"
+	"time"
+)
+
+/*
+	graceful shutdown
+
+	1, stop accepting tcp conns, reject new publish, bind and get with 503
+	2, tell consumers to stop, tcp conns get Shutdown proto, websocket
+		conns get shutdown action, sse streams end
+	3, stop pushing new msgs, wait msgs pushed before to be acked, or ctx done
+	4, close all conns, msgs not acked are kept in store and will be pushed
+		again after restart
+	5, stop queues and close store
+*/
+
+const shutdownCheckInterval = 100 * time.Millisecond
+
+func (app *App) isClosing() bool {
+	select {
+	case <-app.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (app *App) startShutdown() {
+	app.quitOnce.Do(func() {
+		close(app.quit)
+
+		if app.listener != nil {
+			app.listener.Close()
+		}
+	})
+}
+
+//Shutdown closes app gracefully, it returns ctx error if msgs pushed are
+//not all acked before ctx done, app is closed anyway
+func (app *App) Shutdown(ctx context.Context) error {
+	app.startShutdown()
+
+	for _, c := range app.listConns() {
+		c.writeProto(proto.NewShutdownProto().P)
+	}
+
+	err := app.waitDeliveries(ctx)
+	if err != nil {
+		log.Infof("shutdown with msgs not acked: %v", err)
+	}
+
+	app.Close()
+
+	return err
+}
+
+func (app *App) waitDeliveries(ctx context.Context) error {
+	for {
+		inflight := false
+		for _, rq := range app.qs.List() {
+			r := make(chan bool, 1)
+			go func(rq *queue) {
+				r <- rq.Inflight()
+			}(rq)
+
+			select {
+			case inflight = <-r:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if inflight {
+				break
+			}
+		}
+
+		if !inflight {
+			return nil
+		}
+
+		select {
+		case <-time.After(shutdownCheckInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
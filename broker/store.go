@@ -17,6 +17,11 @@ type Store interface {
 	Pop(queue string) error
 	Front(queue string) (*msg, error)
 	Len(queue string) (int, error)
+
+	//Peek returns at most n msgs from front without deleting them
+	Peek(queue string, n int) ([]*msg, error)
+	//Purge deletes all msgs of queue
+	Purge(queue string) error
 }
 
 var stores = map[string]StoreDriver{}
@@ -2,8 +2,10 @@ package broker
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func testStore(s Store, checkLen bool) error {
@@ -45,6 +47,14 @@ func testStore(s Store, checkLen bool) error {
 		return fmt.Errorf("not equal")
 	}
 
+	if ms, err := s.Peek(queue, 3); err != nil {
+		return err
+	} else if len(ms) != 2 {
+		return fmt.Errorf("peek %d != 2", len(ms))
+	} else if !reflect.DeepEqual(m1, ms[0]) || !reflect.DeepEqual(m2, ms[1]) {
+		return fmt.Errorf("peek not equal")
+	}
+
 	if err := s.Pop(queue); err != nil {
 		return err
 	}
@@ -75,10 +85,30 @@ func testStore(s Store, checkLen bool) error {
 		}
 	}
 
+	if err = s.Save(queue, m1); err != nil {
+		return err
+	}
+
+	if err = s.Purge(queue); err != nil {
+		return err
+	}
+
+	if m, err := s.Front(queue); err != nil {
+		return err
+	} else if m != nil {
+		return fmt.Errorf("purge failed")
+	}
+
 	return nil
 }
 
 func TestRedisStore(t *testing.T) {
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:6379", time.Second); err != nil {
+		t.Skip("redis is not available", err)
+	} else {
+		conn.Close()
+	}
+
 	var config = []byte(`
     {
         "addr":"127.0.0.1:6379",
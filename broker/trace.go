@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"github.com/siddontang/moonmq/proto"
+	"strconv"
+)
+
+/*
+	broker continues the trace in msg header traceparent with spans
+
+	publish: msg saved, child of publisher context, its context is stored
+		as msg traceparent
+	route: channels selected for msg, child of publish
+	deliver: msg pushed to one consumer, child of route, consumer gets its
+		context as traceparent
+	ack: consumer acked or nacked msg, child of publish
+
+	no span is created until a tracer is set with App.SetTracer.
+*/
+
+const (
+	SpanPublish = "publish"
+	SpanRoute   = "route"
+	SpanDeliver = "deliver"
+	SpanAck     = "ack"
+)
+
+//Tracer creates spans, parent is invalid if msg has no trace context, then
+//tracer may start a new trace or return a span with invalid context
+type Tracer interface {
+	StartSpan(name string, parent proto.TraceContext, attrs map[string]string) Span
+}
+
+type Span interface {
+	//context propagated to next spans and consumers
+	Context() proto.TraceContext
+	SetAttribute(key string, value string)
+	End(err error)
+}
+
+type noopSpan struct {
+	ctx proto.TraceContext
+}
+
+func (s noopSpan) Context() proto.TraceContext { return s.ctx }
+
+func (s noopSpan) SetAttribute(key string, value string) {}
+
+func (s noopSpan) End(err error) {}
+
+type tracerHolder struct {
+	t Tracer
+}
+
+//SetTracer sets tracer for all spans, nil disables tracing
+func (app *App) SetTracer(t Tracer) {
+	app.tracer.Store(tracerHolder{t})
+}
+
+func (app *App) startSpan(name string, parent proto.TraceContext, attrs map[string]string) Span {
+	h, _ := app.tracer.Load().(tracerHolder)
+	if h.t == nil {
+		return noopSpan{parent}
+	}
+
+	return h.t.StartSpan(name, parent, attrs)
+}
+
+func msgAttrs(queue string, m *msg) map[string]string {
+	return map[string]string{
+		"queue":       queue,
+		"msg_id":      strconv.FormatInt(m.id, 10),
+		"routing_key": m.routingKey,
+	}
+}
+
+//withTrace returns headers with traceparent of span, copied if changed
+func withTrace(headers map[string]string, span Span) (map[string]string, bool) {
+	tc := span.Context()
+	if !tc.Valid() {
+		return headers, false
+	}
+
+	v := tc.String()
+	if headers[proto.TraceparentHeader] == v {
+		return headers, false
+	}
+
+	hs := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		hs[k] = v
+	}
+	hs[proto.TraceparentHeader] = v
+
+	return hs, true
+}
+
+func msgTrace(m *msg) proto.TraceContext {
+	tc, _ := proto.TraceFromHeaders(m.headers)
+	return tc
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//strategies to select broker for new conn
+const (
+	//try brokers in config order
+	FailoverStrategy = "failover"
+	//start from next broker every time
+	RoundRobinStrategy = "round_robin"
+	RandomStrategy     = "random"
+)
+
+func validStrategy(s string) bool {
+	switch s {
+	case FailoverStrategy, RoundRobinStrategy, RandomStrategy:
+		return true
+	default:
+		return false
+	}
+}
+
+//BrokerHealth is health of one broker address
+type BrokerHealth struct {
+	Addr string
+	//false if last dial or publish failed in broker_down_interval
+	Healthy bool
+	//continuous failures
+	Failures  int
+	LastError error
+}
+
+type brokerAddr struct {
+	addr string
+
+	failures  int
+	lastError error
+	downUntil time.Time
+}
+
+type balancer struct {
+	sync.Mutex
+
+	strategy string
+
+	downInterval time.Duration
+
+	addrs []*brokerAddr
+
+	next int
+
+	rand *rand.Rand
+}
+
+func newBalancer(cfg *Config) *balancer {
+	b := new(balancer)
+
+	b.strategy = cfg.Strategy
+
+	if cfg.BrokerDownInterval > 0 {
+		b.downInterval = time.Duration(cfg.BrokerDownInterval) * time.Millisecond
+	} else {
+		b.downInterval = time.Duration(defaultBrokerDownInterval) * time.Millisecond
+	}
+
+	addrs := cfg.BrokerAddrs
+	if len(addrs) == 0 {
+		addrs = []string{cfg.BrokerAddr}
+	}
+
+	for _, addr := range addrs {
+		b.addrs = append(b.addrs, &brokerAddr{addr: addr})
+	}
+
+	b.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	return b
+}
+
+//order returns addrs in trying order, healthy ones first
+func (b *balancer) order() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	n := len(b.addrs)
+	addrs := make([]*brokerAddr, 0, n)
+
+	switch b.strategy {
+	case RoundRobinStrategy:
+		for i := 0; i < n; i++ {
+			addrs = append(addrs, b.addrs[(b.next+i)%n])
+		}
+		b.next = (b.next + 1) % n
+	case RandomStrategy:
+		for _, i := range b.rand.Perm(n) {
+			addrs = append(addrs, b.addrs[i])
+		}
+	default:
+		addrs = append(addrs, b.addrs...)
+	}
+
+	now := time.Now()
+	healthy := make([]string, 0, n)
+	var down []string
+	for _, a := range addrs {
+		if now.Before(a.downUntil) {
+			down = append(down, a.addr)
+		} else {
+			healthy = append(healthy, a.addr)
+		}
+	}
+
+	//still try down brokers if all are down
+	return append(healthy, down...)
+}
+
+func (b *balancer) get(addr string) *brokerAddr {
+	for _, a := range b.addrs {
+		if a.addr == addr {
+			return a
+		}
+	}
+	return nil
+}
+
+func (b *balancer) markFail(addr string, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if a := b.get(addr); a != nil {
+		a.failures++
+		a.lastError = err
+		a.downUntil = time.Now().Add(b.downInterval)
+	}
+}
+
+func (b *balancer) markOK(addr string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if a := b.get(addr); a != nil {
+		a.failures = 0
+		a.lastError = nil
+		a.downUntil = time.Time{}
+	}
+}
+
+func (b *balancer) health() []BrokerHealth {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	hs := make([]BrokerHealth, 0, len(b.addrs))
+	for _, a := range b.addrs {
+		hs = append(hs, BrokerHealth{a.addr, !now.Before(a.downUntil), a.failures, a.lastError})
+	}
+
+	return hs
+}
+
+//dial tries brokers in order until one succeeds
+func (b *balancer) dial(f func(addr string) error) (string, error) {
+	var err error
+	for _, addr := range b.order() {
+		if err = f(addr); err == nil {
+			b.markOK(addr)
+			return addr, nil
+		}
+
+		b.markFail(addr, err)
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no broker address")
+	}
+
+	return "", err
+}
@@ -1,15 +1,39 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ErrChannelClosed = errors.New("channel has been closed")
 
+var ErrDropPolicyAck = errors.New("drop policy is only allowed for no ack channel")
+
+//DropPolicy decides what to do with a pushed msg when channel buffer,
+//max_queue_size msgs, is full
+type DropPolicy int32
+
+const (
+	//block conn read loop until buffer has room, broker stops pushing
+	//when socket is full, so client drops no msg. but broker closes the
+	//conn if it is not read in broker write_timeout, so a slow consumer
+	//can't block the queue for others. msgs waiting ack are pushed again
+	//then, but no ack msgs pushed and not read yet are lost, broker has
+	//taken them as delivered
+	DropNone DropPolicy = iota
+	//discard the oldest buffered msg
+	DropOldest
+	//discard the pushed msg
+	DropNewest
+)
+
 type channelMsg struct {
-	ID   string
-	Body []byte
+	ID      string
+	Headers map[string]string
+	Body    []byte
 }
 
 type Channel struct {
@@ -18,8 +42,13 @@ type Channel struct {
 	routingKey string
 	noAck      bool
 
-	msg    chan *channelMsg
-	closed bool
+	msg chan *channelMsg
+
+	closeOnce sync.Once
+	quit      chan struct{}
+
+	dropPolicy int32
+	dropped    int64
 
 	lastId string
 }
@@ -34,18 +63,59 @@ func newChannel(c *Conn, queue string, routingKey string, noAck bool) *Channel {
 
 	ch.msg = make(chan *channelMsg, c.cfg.MaxQueueSize)
 
-	ch.closed = false
+	ch.quit = make(chan struct{})
 	return ch
 }
 
+//SetDropPolicy lets a no ack channel drop msgs instead of blocking all
+//msgs and replies of the conn when consumer is slow. Acked channel can't
+//drop, broker takes dropped msg as delivered. a no ack channel loses msgs
+//with DropNone too if it blocks the conn longer than broker write_timeout,
+//see DropNone
+func (c *Channel) SetDropPolicy(p DropPolicy) error {
+	if p != DropNone && !c.noAck {
+		return ErrDropPolicyAck
+	}
+
+	atomic.StoreInt32(&c.dropPolicy, int32(p))
+	return nil
+}
+
+//Dropped returns msgs dropped by drop policy
+func (c *Channel) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+//stop wakes up push blocked by full buffer, channel gets no more msgs
+func (c *Channel) stop() {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+	})
+}
+
 func (c *Channel) Close() error {
-	c.closed = true
+	return c.CloseContext(context.Background())
+}
+
+func (c *Channel) CloseContext(ctx context.Context) error {
+	//unbind reply can't be read if read loop is blocked in push
+	c.stop()
+
+	return c.c.unbind(ctx, c.queue)
+}
 
-	return c.c.unbind(c.queue)
+//isClosed is safe to call from any goroutine, stop closes quit only once
+func (c *Channel) isClosed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Channel) Ack() error {
-	if c.closed {
+	if c.isClosed() {
 		return ErrChannelClosed
 	}
 
@@ -53,36 +123,84 @@ func (c *Channel) Ack() error {
 }
 
 func (c *Channel) GetMsg() []byte {
-	if c.closed && len(c.msg) == 0 {
-		return nil
-	}
-
-	msg := <-c.msg
-	c.lastId = msg.ID
-	return msg.Body
+	body, _ := c.GetMsgContext(context.Background())
+	return body
 }
 
 func (c *Channel) WaitMsg(d time.Duration) []byte {
-	if c.closed && len(c.msg) == 0 {
-		return nil
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	body, _ := c.GetMsgContext(ctx)
+	return body
+}
+
+//GetMsgContext waits msg until ctx is done, returns ErrChannelClosed if
+//channel is closed and no msg left
+func (c *Channel) GetMsgContext(ctx context.Context) ([]byte, error) {
+	//msgs left in buffer are still got after close
+	select {
+	case msg := <-c.msg:
+		return c.takeMsg(msg), nil
+	default:
 	}
 
 	select {
-	case <-time.After(d):
-		return nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case msg := <-c.msg:
-		c.lastId = msg.ID
-		return msg.Body
+		return c.takeMsg(msg), nil
+	case <-c.quit:
+		select {
+		case msg := <-c.msg:
+			return c.takeMsg(msg), nil
+		default:
+			return nil, ErrChannelClosed
+		}
 	}
 }
 
-func (c *Channel) pushMsg(msgId string, body []byte) {
-	for {
+func (c *Channel) takeMsg(msg *channelMsg) []byte {
+	c.lastId = msg.ID
+	return msg.Body
+}
+
+func (c *Channel) pushMsg(msgId string, headers map[string]string, body []byte) {
+	m := &channelMsg{msgId, headers, body}
+
+	switch DropPolicy(atomic.LoadInt32(&c.dropPolicy)) {
+	case DropOldest:
+		for {
+			select {
+			case c.msg <- m:
+				return
+			default:
+				select {
+				case <-c.msg:
+					atomic.AddInt64(&c.dropped, 1)
+				default:
+				}
+			}
+		}
+	case DropNewest:
+		select {
+		case c.msg <- m:
+		default:
+			atomic.AddInt64(&c.dropped, 1)
+		}
+	default:
+		//msg pushed to a closing channel is pushed again by broker if
+		//not acked
 		select {
-		case c.msg <- &channelMsg{msgId, body}:
+		case c.msg <- m:
 			return
 		default:
-			<-c.msg
+		}
+
+		select {
+		case c.msg <- m:
+		case <-c.quit:
+		case <-c.c.quit:
 		}
 	}
 }
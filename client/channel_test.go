@@ -0,0 +1,100 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"testing"
+	"time"
+)
+
+func TestChannelCloseWakesGet(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+
+	c := testConn(t, b)
+	defer c.Close()
+
+	ch, err := c.Bind("test_close_get", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ch.GetMsgContext(context.Background())
+		done <- err
+	}()
+
+	//let get block on empty buffer first
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != client.ErrChannelClosed {
+			t.Fatalf("get after close returns %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get is not woken by close")
+	}
+
+	if msg := ch.GetMsg(); msg != nil {
+		t.Fatalf("get msg %q from closed channel", msg)
+	}
+}
+
+func TestChannelBackpressure(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	queue := "test_queue_backpressure"
+	n := 64
+
+	ch, err := c.Bind(queue, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ch.SetDropPolicy(client.DropOldest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Bind(queue, "", false); err != nil {
+		t.Fatal(err)
+	} else if err = ch.SetDropPolicy(client.DropOldest); err != client.ErrDropPolicyAck {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Bind(queue, "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	//buffer is 16 msgs, nothing is dropped without drop policy
+	for i := 0; i < n; i++ {
+		b.Publish(queue, "", []byte(fmt.Sprintf("%d", i)))
+	}
+
+	for i := 0; i < n; i++ {
+		if msg := ch.WaitMsg(2 * time.Second); string(msg) != fmt.Sprintf("%d", i) {
+			t.Fatal(i, string(msg))
+		}
+	}
+
+	if ch.Dropped() != 0 {
+		t.Fatal(ch.Dropped())
+	}
+
+	//closing a full channel doesn't block
+	for i := 0; i < n; i++ {
+		b.Publish(queue, "", []byte("x"))
+	}
+
+	if err = ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,11 +2,15 @@ package client
 
 import (
 	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/siddontang/moonmq/proto"
 	"sync"
 )
 
+var ErrClientClosed = errors.New("client has been closed")
+
 type Client struct {
 	sync.Mutex
 
@@ -14,6 +18,19 @@ type Client struct {
 
 	conns *list.List
 
+	//shared conn for pipelined async publishing
+	pubConn *Conn
+
+	stateCallback StateCallback
+
+	//used by PublishValue, json if nil
+	codec Codec
+
+	publishInterceptors []PublishInterceptor
+	consumeInterceptors []ConsumeInterceptor
+
+	balancer *balancer
+
 	closed bool
 }
 
@@ -24,6 +41,8 @@ func NewClientWithConfig(cfg *Config) (*Client, error) {
 	c.conns = list.New()
 	c.closed = false
 
+	c.balancer = newBalancer(cfg)
+
 	return c, nil
 }
 
@@ -52,26 +71,142 @@ func (c *Client) Close() {
 		conn := e.Value.(*Conn)
 		conn.close()
 	}
+
+	if c.pubConn != nil {
+		c.pubConn.close()
+		c.pubConn = nil
+	}
 }
 
 func (c *Client) Get() (*Conn, error) {
-	co := c.popConn()
+	return c.GetContext(context.Background())
+}
+
+//GetContext returns an idle conn or dials a new one, ctx bounds dialing
+func (c *Client) GetContext(ctx context.Context) (*Conn, error) {
+	return c.getConn(ctx, nil)
+}
+
+//getConn returns an idle conn not connected to skip addrs, or dials one
+func (c *Client) getConn(ctx context.Context, skip map[string]bool) (*Conn, error) {
+	co := c.popConn(skip)
 	if co != nil {
 		return co, nil
 	} else {
-		return newConn(c)
+		return newConn(ctx, c)
 	}
 }
 
+//Brokers returns health of all broker addresses
+func (c *Client) Brokers() []BrokerHealth {
+	return c.balancer.health()
+}
+
+//Publish retries on another broker if conn fails or broker is shutting
+//down, so msg may be published more than once if broker saved it but
+//conn failed before reply
 func (c *Client) Publish(queue string, routingKey string, body []byte, pubType string) (int64, error) {
-	conn, err := c.Get()
+	return c.PublishWithHeadersContext(context.Background(), queue, routingKey, nil, body, pubType)
+}
+
+func (c *Client) PublishContext(ctx context.Context, queue string, routingKey string,
+	body []byte, pubType string) (int64, error) {
+	return c.PublishWithHeadersContext(ctx, queue, routingKey, nil, body, pubType)
+}
+
+//PublishWithHeaders is Publish with msg headers
+func (c *Client) PublishWithHeaders(queue string, routingKey string, headers map[string]string,
+	body []byte, pubType string) (int64, error) {
+	return c.PublishWithHeadersContext(context.Background(), queue, routingKey, headers, body, pubType)
+}
+
+//PublishWithHeadersContext doesn't retry after ctx is done
+func (c *Client) PublishWithHeadersContext(ctx context.Context, queue string, routingKey string,
+	headers map[string]string, body []byte, pubType string) (int64, error) {
+	var err error
+	tried := make(map[string]bool, len(c.balancer.addrs))
+	for i := 0; i < len(c.balancer.addrs); i++ {
+		var conn *Conn
+		if conn, err = c.getConn(ctx, tried); err != nil {
+			return 0, err
+		}
+
+		var id int64
+		id, err = conn.PublishWithHeadersContext(ctx, queue, routingKey, headers, body, pubType)
+		if err == nil {
+			conn.Close()
+			return id, nil
+		} else if re, ok := err.(*ReplyError); ok && !re.shuttingDown() {
+			conn.Close()
+			return 0, err
+		} else if ctx.Err() != nil {
+			//broker may be ok, reply is just late
+			conn.close()
+			return 0, err
+		}
+
+		//conn failed or broker is shutting down, try another broker
+		tried[conn.Addr()] = true
+		c.balancer.markFail(conn.Addr(), err)
+		conn.close()
+	}
+
+	return 0, err
+}
+
+//PublishAsync pipelines publishes in one shared conn, see Conn.PublishAsync
+func (c *Client) PublishAsync(queue string, routingKey string, body []byte, pubType string,
+	confirm func(msgId int64, err error)) *PublishFuture {
+	conn, err := c.getPubConn()
 	if err != nil {
-		return 0, err
+		f := newPublishFuture(confirm)
+		f.finish(0, err)
+		return f
+	}
+
+	return conn.PublishAsync(queue, routingKey, body, pubType, confirm)
+}
+
+//getPubConn dials without lock, so a slow or unreachable broker doesn't
+//block Close and other publishers
+func (c *Client) getPubConn() (*Conn, error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil, ErrClientClosed
 	}
 
-	defer conn.Close()
+	if co := c.pubConn; co != nil && !co.closed && !co.isDisconnected() {
+		c.Unlock()
+		return co, nil
+	}
+	c.Unlock()
+
+	//balancer selects addr under its own lock
+	co, err := newConn(context.Background(), c)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
 
-	return conn.Publish(queue, routingKey, body, pubType)
+	if c.closed {
+		co.close()
+		return nil, ErrClientClosed
+	}
+
+	//another publisher may have dialed meanwhile
+	if old := c.pubConn; old != nil {
+		if !old.closed && !old.isDisconnected() {
+			co.close()
+			return old, nil
+		}
+		old.close()
+	}
+
+	c.pubConn = co
+	return co, nil
 }
 
 func (c *Client) PublishFanout(queue string, body []byte) (int64, error) {
@@ -82,22 +217,30 @@ func (c *Client) PublishDirect(queue string, routingKey string, body []byte) (in
 	return c.Publish(queue, routingKey, body, proto.DirectPubTypeStr)
 }
 
-func (c *Client) popConn() *Conn {
+//popConn skips conns connected to skip addrs, they are kept idle
+func (c *Client) popConn(skip map[string]bool) *Conn {
 	c.Lock()
 	defer c.Unlock()
 
-	for {
-		if c.conns.Len() == 0 {
-			return nil
-		} else {
-			e := c.conns.Front()
+	for e := c.conns.Front(); e != nil; {
+		next := e.Next()
+
+		conn := e.Value.(*Conn)
+		if conn.closed {
+			c.conns.Remove(e)
+		} else if conn.isDisconnected() {
+			//idle conn has no channel, needn't wait reconnecting
 			c.conns.Remove(e)
-			conn := e.Value.(*Conn)
-			if !conn.closed {
-				return conn
-			}
+			conn.close()
+		} else if !skip[conn.Addr()] {
+			c.conns.Remove(e)
+			return conn
 		}
+
+		e = next
 	}
+
+	return nil
 }
 
 func (c *Client) pushConn(co *Conn) {
@@ -0,0 +1,205 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"net"
+	"testing"
+	"time"
+)
+
+//testConn gets a conn of broker client, caller closes it
+func testConn(t *testing.T, b *mmqtest.Broker) *client.Conn {
+	t.Helper()
+
+	c, err := b.Client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestClientCloseWhileDialing(t *testing.T) {
+	//broker accepts but never handshakes, so dialing shared pub conn blocks
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	cfg := client.NewDefaultConfig()
+	cfg.BrokerAddr = l.Addr().String()
+
+	c, err := client.NewClientWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan error, 1)
+	go func() {
+		f := c.PublishAsync("test_queue", "", []byte("123"), "direct", nil)
+		_, err := f.Wait()
+		published <- err
+	}()
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish doesn't dial")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close is blocked by dialing publish")
+	}
+
+	//handshake fails now and publish sees client closed or conn error
+	conn.Close()
+
+	select {
+	case err := <-published:
+		if err == nil {
+			t.Fatal("publish succeeds without broker")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish is not done after conn closed")
+	}
+}
+
+func TestMultiBroker(t *testing.T) {
+	addr := mmqtest.NewBroker(t).Addr()
+
+	//a port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := l.Addr().String()
+	l.Close()
+
+	for _, strategy := range []string{"failover", "round_robin", "random"} {
+		cli, err := client.NewClient([]byte(fmt.Sprintf(`
+        {
+            "broker_addrs":["%s", "%s"],
+            "strategy":"%s"
+        }`, downAddr, addr, strategy)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err = cli.Publish("test_queue_multi_broker", "", []byte("123"), "direct"); err != nil {
+				t.Fatal(strategy, err)
+			}
+		}
+
+		for _, h := range cli.Brokers() {
+			if h.Addr == addr && !h.Healthy {
+				t.Fatal(strategy, h)
+			} else if h.Addr == downAddr && (h.Healthy && strategy == "failover") {
+				t.Fatal(strategy, h)
+			}
+		}
+
+		cli.Close()
+	}
+}
+
+func TestContext(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	queue := "test_queue_context"
+
+	ch, err := c.Bind(queue, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err = ch.GetMsgContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	if _, err = c.PublishContext(ctx, queue, "", []byte("123"), "direct"); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	if _, err = c.GetMsgsContext(ctx, queue+"_get", "", 1, time.Second, false); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	//broker accepts but never handshakes
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cli, err := client.NewClient([]byte(fmt.Sprintf(`{"broker_addr":"%s"}`, l.Addr().String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err = cli.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	} else if d := time.Now().Sub(start); d > time.Second {
+		t.Fatal("dial not canceled in time", d)
+	}
+
+	//conn must not time out by ctx deadline before ctx is done, or io
+	//error is returned instead of ctx error
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	dctx := &earlyDeadlineCtx{ctx, time.Now().Add(10 * time.Millisecond)}
+	if _, err = cli.GetContext(dctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+//earlyDeadlineCtx reports a deadline before it is done
+type earlyDeadlineCtx struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c *earlyDeadlineCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+//ContentTypeHeader is set by PublishValue, Delivery.Decode selects codec with it
+const ContentTypeHeader = "content_type"
+
+//Codec marshals values to msg bodies
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+//ProtoMessage is implemented by generated protobuf messages, e.g, gogo
+//protobuf, so client needn't depend on a protobuf package
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return m.Marshal()
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return m.Unmarshal(data)
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	GobCodec      Codec = gobCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var codecLock sync.RWMutex
+var codecs = map[string]Codec{}
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(GobCodec)
+	RegisterCodec(ProtobufCodec)
+}
+
+//RegisterCodec lets Delivery.Decode find codec by content type, it replaces
+//codec registered with same content type
+func RegisterCodec(c Codec) {
+	codecLock.Lock()
+	codecs[c.ContentType()] = c
+	codecLock.Unlock()
+}
+
+//GetCodec returns nil if no codec registered for content type
+func GetCodec(contentType string) Codec {
+	codecLock.RLock()
+	c := codecs[contentType]
+	codecLock.RUnlock()
+
+	return c
+}
+
+//SetCodec sets codec PublishValue uses, json by default
+func (c *Client) SetCodec(codec Codec) {
+	c.Lock()
+	c.codec = codec
+	c.Unlock()
+}
+
+func (c *Client) getCodec() Codec {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.codec == nil {
+		return JSONCodec
+	}
+	return c.codec
+}
+
+func marshalValue(codec Codec, v interface{}) (map[string]string, []byte, error) {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return map[string]string{ContentTypeHeader: codec.ContentType()}, body, nil
+}
+
+//PublishValue marshals v with client codec and sets content type header
+func (c *Client) PublishValue(queue string, routingKey string, v interface{}, pubType string) (int64, error) {
+	headers, body, err := marshalValue(c.getCodec(), v)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.PublishWithHeaders(queue, routingKey, headers, body, pubType)
+}
+
+//PublishValue marshals v with client codec and sets content type header
+func (c *Conn) PublishValue(queue string, routingKey string, v interface{}, pubType string) (int64, error) {
+	headers, body, err := marshalValue(c.client.getCodec(), v)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.PublishWithHeaders(queue, routingKey, headers, body, pubType)
+}
+
+//Decode unmarshals body with client codec if msg has no content type or
+//the same one as it, so codec set by SetCodec needn't be registered,
+//otherwise with codec registered for content type header
+func (d *Delivery) Decode(v interface{}) error {
+	codec := d.conn.client.getCodec()
+	if contentType, ok := d.Headers[ContentTypeHeader]; ok && contentType != codec.ContentType() {
+		if codec = GetCodec(contentType); codec == nil {
+			return fmt.Errorf("no codec for content type %s", contentType)
+		}
+	}
+
+	return codec.Unmarshal(d.Body, v)
+}
@@ -0,0 +1,116 @@
+package client_test
+
+import (
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"strings"
+	"testing"
+)
+
+type testProtoMsg struct {
+	Name string
+}
+
+func (m *testProtoMsg) Marshal() ([]byte, error) {
+	return []byte("pb:" + m.Name), nil
+}
+
+func (m *testProtoMsg) Unmarshal(data []byte) error {
+	m.Name = strings.TrimPrefix(string(data), "pb:")
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	cli := b.NewClient()
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	queue := "test_queue_codec"
+
+	ds := make(chan *client.Delivery, 4)
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		ds <- d
+		return nil
+	}, &client.ConsumeOptions{NoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	type value struct {
+		Name string
+		N    int
+	}
+
+	for _, codec := range []client.Codec{client.JSONCodec, client.GobCodec} {
+		cli.SetCodec(codec)
+		if _, err = cli.PublishValue(queue, "", &value{"a", 1}, "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cli.SetCodec(client.ProtobufCodec)
+	if _, err = cli.PublishValue(queue, "", &value{"a", 1}, "direct"); err == nil {
+		t.Fatal("must fail to marshal non protobuf value")
+	}
+	if _, err = c.PublishValue(queue, "", &testProtoMsg{"b"}, "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	//decode by content type header, not client codec
+	for _, contentType := range []string{"application/json", "application/x-gob"} {
+		d := <-ds
+		if d.Headers[client.ContentTypeHeader] != contentType {
+			t.Fatal(d.Headers)
+		}
+
+		var v value
+		if err = d.Decode(&v); err != nil {
+			t.Fatal(err)
+		} else if v.Name != "a" || v.N != 1 {
+			t.Fatal(v)
+		}
+	}
+
+	d := <-ds
+	var m testProtoMsg
+	if err = d.Decode(&m); err != nil {
+		t.Fatal(err)
+	} else if m.Name != "b" || string(d.Body) != "pb:b" {
+		t.Fatal(m.Name, string(d.Body))
+	}
+
+	//client codec decodes its content type without being registered
+	cli.SetCodec(testCodec{})
+	if _, err = c.PublishValue(queue, "", &testProtoMsg{"c"}, "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	d = <-ds
+	if err = d.Decode(&m); err != nil {
+		t.Fatal(err)
+	} else if m.Name != "c" || d.Headers[client.ContentTypeHeader] != "application/x-test" {
+		t.Fatal(m.Name, d.Headers)
+	}
+}
+
+//testCodec is not registered
+type testCodec struct {
+}
+
+func (testCodec) ContentType() string {
+	return "application/x-test"
+}
+
+func (testCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.(*testProtoMsg).Marshal()
+}
+
+func (testCodec) Unmarshal(data []byte, v interface{}) error {
+	return v.(*testProtoMsg).Unmarshal(data)
+}
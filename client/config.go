@@ -2,15 +2,49 @@ package client
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/siddontang/moonmq/proto"
 )
 
 const defaultQueueSize int = 16
 
+const (
+	defaultKeepAlive            int = 60
+	defaultReconnectInterval    int = 100
+	defaultReconnectMaxInterval int = 10000
+	defaultBrokerDownInterval   int = 5000
+)
+
 type Config struct {
-	BrokerAddr   string `json:"broker_addr"`
-	KeepAlive    int    `json:"keepalive"`
-	IdleConns    int    `json:"idle_conns"`
-	MaxQueueSize int    `json:"max_queue_size"`
+	BrokerAddr string `json:"broker_addr"`
+
+	//brokers to connect, BrokerAddr is used if empty
+	BrokerAddrs []string `json:"broker_addrs"`
+	//failover, round_robin or random, see balancer.go
+	Strategy string `json:"strategy"`
+	//milliseconds a broker failed is tried after healthy ones
+	BrokerDownInterval int `json:"broker_down_interval"`
+
+	KeepAlive int `json:"keepalive"`
+	IdleConns int `json:"idle_conns"`
+	//msgs buffered in a channel, conn stops reading when one is full,
+	//unless channel has a drop policy
+	MaxQueueSize int `json:"max_queue_size"`
+
+	//preferred proto header encoding, binary or json
+	HeaderEncoding string `json:"header_encoding"`
+
+	//preferred body compressions, e.g, zstd,snappy,gzip, empty for none
+	Compression       string `json:"compression"`
+	CompressThreshold int    `json:"compress_threshold"`
+
+	//conn reconnects with exponential backoff after losing socket, and
+	//binds its channels again, interval is in milliseconds
+	DisableReconnect     bool `json:"disable_reconnect"`
+	ReconnectInterval    int  `json:"reconnect_interval"`
+	ReconnectMaxInterval int  `json:"reconnect_max_interval"`
+	//0 means reconnecting until conn is closed
+	MaxReconnects int `json:"max_reconnects"`
 }
 
 func NewDefaultConfig() *Config {
@@ -20,6 +54,14 @@ func NewDefaultConfig() *Config {
 	cfg.KeepAlive = 60
 	cfg.IdleConns = 2
 	cfg.MaxQueueSize = 16
+	cfg.HeaderEncoding = proto.BinaryEncoding
+	cfg.CompressThreshold = proto.DefaultCompressThreshold
+
+	cfg.ReconnectInterval = defaultReconnectInterval
+	cfg.ReconnectMaxInterval = defaultReconnectMaxInterval
+
+	cfg.Strategy = FailoverStrategy
+	cfg.BrokerDownInterval = defaultBrokerDownInterval
 
 	return cfg
 }
@@ -35,5 +77,38 @@ func parseConfigJson(buf json.RawMessage) (*Config, error) {
 		c.MaxQueueSize = defaultQueueSize
 	}
 
+	if len(c.HeaderEncoding) == 0 {
+		c.HeaderEncoding = proto.BinaryEncoding
+	}
+
+	if c.CompressThreshold <= 0 {
+		c.CompressThreshold = proto.DefaultCompressThreshold
+	}
+
+	if len(c.Strategy) == 0 {
+		c.Strategy = FailoverStrategy
+	} else if !validStrategy(c.Strategy) {
+		return nil, fmt.Errorf("invalid strategy %s", c.Strategy)
+	}
+
+	if c.BrokerDownInterval <= 0 {
+		c.BrokerDownInterval = defaultBrokerDownInterval
+	}
+
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = defaultKeepAlive
+	}
+
+	if c.ReconnectInterval <= 0 {
+		c.ReconnectInterval = defaultReconnectInterval
+	}
+
+	if c.ReconnectMaxInterval < c.ReconnectInterval {
+		c.ReconnectMaxInterval = defaultReconnectMaxInterval
+		if c.ReconnectMaxInterval < c.ReconnectInterval {
+			c.ReconnectMaxInterval = c.ReconnectInterval
+		}
+	}
+
 	return c, nil
 }
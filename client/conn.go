@@ -1,12 +1,14 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"github.com/siddontang/moonmq/proto"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,46 +21,69 @@ type Conn struct {
 
 	cfg *Config
 
-	conn net.Conn
+	//conn, decoder and encoder are replaced when reconnecting, holding
+	//both writeLock and connLock
+	connLock sync.Mutex
+	conn     net.Conn
+	//broker address conn connects
+	addr string
 
 	decoder *proto.Decoder
+	encoder *proto.Encoder
 
 	grab chan struct{}
-	wait chan *proto.Proto
 
-	closed bool
+	closed    bool
+	closeOnce sync.Once
+	quit      chan struct{}
+
+	//socket lost and reconnecting
+	disconnected bool
 
 	lastHeartbeat int64
 
 	channels map[string]*Channel
+
+	//run after client interceptors, cleared when conn is put back to pool
+	publishInterceptors []PublishInterceptor
+	consumeInterceptors []ConsumeInterceptor
+
+	flowLock sync.Mutex
+	//not nil when broker asks us to pause publishing
+	resume chan struct{}
+
+	reqId uint64
+
+	pendingLock sync.Mutex
+	//replies waited by req_id, nil after conn closed
+	pending map[string]func(p *proto.Proto)
 }
 
-func newConn(client *Client) (*Conn, error) {
+func newConn(ctx context.Context, client *Client) (*Conn, error) {
 	c := new(Conn)
 
 	c.client = client
 	c.cfg = client.cfg
 
-	var n string = "tcp"
-	if strings.Contains(c.cfg.BrokerAddr, "/") {
-		n = "unix"
-	}
-
-	var err error
-	if c.conn, err = net.Dial(n, c.cfg.BrokerAddr); err != nil {
+	addr, conn, decoder, encoder, err := c.dial(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	c.decoder = proto.NewDecoder(c.conn)
+	c.addr = addr
+	c.conn = conn
+	c.decoder = decoder
+	c.encoder = encoder
 
 	c.grab = make(chan struct{}, 1)
 	c.grab <- struct{}{}
 
 	c.channels = make(map[string]*Channel)
 
-	c.wait = make(chan *proto.Proto, 1)
+	c.pending = make(map[string]func(p *proto.Proto))
 
 	c.closed = false
+	c.quit = make(chan struct{})
 
 	c.lastHeartbeat = 0
 
@@ -69,8 +94,142 @@ func newConn(client *Client) (*Conn, error) {
 	return c, nil
 }
 
+//dial connects a broker selected by client strategy and handshakes,
+//ctx bounds both connecting and handshake
+func (c *Conn) dial(ctx context.Context) (string, net.Conn, *proto.Decoder, *proto.Encoder, error) {
+	var conn net.Conn
+	var decoder *proto.Decoder
+	var encoder *proto.Encoder
+
+	addr, err := c.client.balancer.dial(func(addr string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var n string = "tcp"
+		if strings.Contains(addr, "/") {
+			n = "unix"
+		}
+
+		var d net.Dialer
+		var err error
+		if conn, err = d.DialContext(ctx, n, addr); err != nil {
+			return err
+		}
+
+		decoder = proto.NewDecoder(conn)
+		encoder = proto.NewEncoder(conn)
+
+		stop := interruptConn(ctx, conn)
+		err = handshake(c.cfg, decoder, encoder)
+		stop()
+
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		return nil
+	})
+
+	return addr, conn, decoder, encoder, err
+}
+
+//interruptConn makes blocked io on conn fail when ctx is done, returned
+//stop clears it and must be called before conn is used without ctx
+func interruptConn(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	//not deadline of ctx, conn may time out before ctx is done, so io
+	//error would be returned instead of ctx error
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			//a deadline in the past fails io immediately
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+//Addr returns broker address conn connects now
+func (c *Conn) Addr() string {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	return c.addr
+}
+
+//handshake before read loop uses decoder, so we can read reply directly
+func handshake(cfg *Config, decoder *proto.Decoder, encoder *proto.Encoder) error {
+	encodings := []string{cfg.HeaderEncoding}
+	if cfg.HeaderEncoding != proto.JsonEncoding {
+		encodings = append(encodings, proto.JsonEncoding)
+	}
+
+	var compressions []string
+	if len(cfg.Compression) > 0 {
+		compressions = strings.Split(cfg.Compression, ",")
+	}
+
+	p := proto.NewHandshakeProto(proto.Version, encodings, compressions)
+	if err := encoder.Encode(p.P); err != nil {
+		return err
+	}
+
+	rp, err := decoder.Decode()
+	if err != nil {
+		return err
+	}
+
+	if rp.Method == proto.Error {
+		return replyError(rp)
+	} else if rp.Method != proto.Handshake_OK {
+		return fmt.Errorf("invalid return method %d != %d", rp.Method, proto.Handshake_OK)
+	}
+
+	encoding := rp.Value(proto.HeaderEncodingStr)
+	if !proto.ValidHeaderEncoding(encoding) {
+		return fmt.Errorf("invalid header encoding %s", encoding)
+	}
+
+	encoder.SetHeaderEncoding(encoding)
+
+	if compression := rp.Value(proto.CompressionStr); len(compression) > 0 {
+		compressor := proto.GetCompressor(compression)
+		if compressor == nil {
+			return fmt.Errorf("invalid compression %s", compression)
+		}
+
+		encoder.SetCompressor(compressor, cfg.CompressThreshold)
+		decoder.SetCompressor(compressor)
+	}
+
+	return nil
+}
+
 func (c *Conn) Close() {
-	c.unbindAll()
+	c.unbindAll(context.Background())
+
+	//interceptors of a conn don't go to next user of pool
+	c.Lock()
+	c.publishInterceptors = nil
+	c.consumeInterceptors = nil
+	c.Unlock()
 
 	c.client.pushConn(c)
 }
@@ -78,114 +237,473 @@ func (c *Conn) Close() {
 func (c *Conn) keepAlive() {
 	var f func()
 	f = func() {
-		p := proto.NewHeartbeatProto()
-		err := c.writeProto(p.P)
-		if err != nil {
-			c.close()
+		if c.closed {
 			return
-		} else {
-			time.AfterFunc(time.Duration(c.cfg.KeepAlive)*time.Second, f)
 		}
+
+		//write error is found by read loop, which reconnects
+		p := proto.NewHeartbeatProto()
+		c.writeProto(p.P)
+
+		time.AfterFunc(time.Duration(c.cfg.KeepAlive)*time.Second, f)
 	}
 	time.AfterFunc(time.Duration(c.cfg.KeepAlive)*time.Second, f)
 }
 
+//close closes conn and stops reconnecting
 func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		c.closed = true
+		close(c.quit)
+	})
+
+	c.connLock.Lock()
 	c.conn.Close()
-	c.closed = true
+	c.connLock.Unlock()
 }
 
 func (c *Conn) run() {
 	defer func() {
-		c.conn.Close()
+		c.close()
 
-		close(c.wait)
+		c.setFlow(true)
 
-		c.closed = true
+		c.closePending()
+
+		c.client.notifyState(c, StateClosed, nil)
 	}()
+
+	for {
+		err := c.readLoop()
+
+		if c.closed || c.cfg.DisableReconnect {
+			return
+		}
+
+		c.connLock.Lock()
+		c.conn.Close()
+		c.disconnected = true
+		c.connLock.Unlock()
+
+		//publishers blocked by flow and requests waiting reply fail now
+		c.setFlow(true)
+		c.failPending()
+
+		c.client.notifyState(c, StateDisconnected, err)
+
+		if !c.reconnect() {
+			return
+		}
+
+		go c.rebind()
+	}
+}
+
+func (c *Conn) isDisconnected() bool {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	return c.disconnected
+}
+
+func (c *Conn) readLoop() error {
 	for {
 		p, err := c.decoder.Decode()
 		if err != nil {
-			return
+			return err
 		}
 
-		if p.Method == proto.Push {
+		if reqId := p.ReqId(); len(reqId) > 0 {
+			if f := c.popPending(reqId); f != nil {
+				f(p)
+				continue
+			}
+		}
+
+		switch p.Method {
+		case proto.Push:
 			queueName := p.Queue()
 			c.Lock()
 			ch, ok := c.channels[queueName]
-			if !ok {
-				c.Unlock()
-				return
-			}
 			c.Unlock()
 
-			ch.pushMsg(p.MsgId(), p.Body)
-		} else {
-			c.wait <- p
+			if ok {
+				//broker sends valid json, ignore error and push without headers
+				headers, _ := p.Headers()
+				ch.pushMsg(p.MsgId(), headers, p.Body)
+			}
+			//else pushed before unbind, broker will repush it
+		case proto.Flow:
+			c.setFlow(p.Value(proto.ActiveStr) == "1")
+		case proto.Shutdown:
+			//broker is shutting down, pushed msgs can still be acked
+			//until broker closes conn, then we reconnect
+			c.client.notifyState(c, StateShutdown, nil)
+		default:
+			//reply without a waiting req_id, e.g, error for async ack, ignore
 		}
+	}
+}
 
+//reconnect dials with exponential backoff, returns false if conn is closed
+//or max reconnects reached
+func (c *Conn) reconnect() bool {
+	interval := time.Duration(c.cfg.ReconnectInterval) * time.Millisecond
+	maxInterval := time.Duration(c.cfg.ReconnectMaxInterval) * time.Millisecond
+
+	for i := 0; c.cfg.MaxReconnects <= 0 || i < c.cfg.MaxReconnects; i++ {
+		select {
+		case <-time.After(interval):
+		case <-c.quit:
+			return false
+		}
+
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+
+		addr, conn, decoder, encoder, err := c.dial(context.Background())
+		if err != nil {
+			continue
+		}
+
+		c.writeLock.Lock()
+		c.connLock.Lock()
+		c.addr = addr
+		c.conn = conn
+		c.decoder = decoder
+		c.encoder = encoder
+		c.disconnected = false
+		c.connLock.Unlock()
+		c.writeLock.Unlock()
+
+		//closed while dialing
+		if c.closed {
+			conn.Close()
+			return false
+		}
+
+		return true
 	}
+
+	return false
 }
 
-func (c *Conn) request(p *proto.Proto, expectMethod uint32) (*proto.Proto, error) {
-	err := c.writeProto(p)
+//rebind binds all channels again after reconnecting, it must run out of
+//read goroutine because it waits replies
+func (c *Conn) rebind() {
+	c.Lock()
+	channels := make([]*Channel, 0, len(c.channels))
+	for _, ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	c.Unlock()
 
-	if err != nil {
+	var err error
+	for _, ch := range channels {
+		p := proto.NewBindProto(ch.queue, ch.routingKey, ch.noAck)
+		if _, e := c.request(context.Background(), p.P, proto.Bind_OK); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	c.client.notifyState(c, StateConnected, err)
+}
+
+func (c *Conn) setFlow(active bool) {
+	c.flowLock.Lock()
+	defer c.flowLock.Unlock()
+
+	if active {
+		if c.resume != nil {
+			close(c.resume)
+			c.resume = nil
+		}
+	} else if c.resume == nil {
+		c.resume = make(chan struct{})
+	}
+}
+
+//block until broker resumes publishing
+func (c *Conn) waitFlow(ctx context.Context) error {
+	c.flowLock.Lock()
+	resume := c.resume
+	c.flowLock.Unlock()
+
+	if resume == nil {
+		return nil
+	}
+
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) nextReqId() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.reqId, 1), 10)
+}
+
+func (c *Conn) addPending(reqId string, f func(p *proto.Proto)) bool {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	if c.pending == nil {
+		return false
+	}
+
+	c.pending[reqId] = f
+	return true
+}
+
+func (c *Conn) popPending(reqId string) func(p *proto.Proto) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	f, ok := c.pending[reqId]
+	if ok {
+		delete(c.pending, reqId)
+	}
+
+	return f
+}
+
+func (c *Conn) closePending() {
+	c.pendingLock.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.pendingLock.Unlock()
+
+	c.replyPending(pending)
+}
+
+//failPending fails requests waiting reply but accepts new ones
+func (c *Conn) failPending() {
+	c.pendingLock.Lock()
+	pending := c.pending
+	if pending != nil {
+		c.pending = make(map[string]func(p *proto.Proto))
+	}
+	c.pendingLock.Unlock()
+
+	c.replyPending(pending)
+}
+
+//nil reply means conn closed before reply
+func (c *Conn) replyPending(pending map[string]func(p *proto.Proto)) {
+	for _, f := range pending {
+		f(nil)
+	}
+}
+
+//ReplyError is error replied by broker, conn is still ok
+type ReplyError struct {
+	Code    string
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("error:%s, code:%s", e.Message, e.Code)
+}
+
+//shuttingDown means broker rejects requests before it stops
+func (e *ReplyError) shuttingDown() bool {
+	return e.Code == "503"
+}
+
+func replyError(rp *proto.Proto) error {
+	return &ReplyError{rp.Fields[proto.CodeStr], string(rp.Body)}
+}
+
+//request can be called concurrently, reply is dispatched by req_id
+func (c *Conn) request(ctx context.Context, p *proto.Proto, expectMethods ...uint32) (*proto.Proto, error) {
+	return c.requestLate(ctx, p, nil, expectMethods...)
+}
+
+//requestLate returns ctx error if ctx is done before reply, late, if not
+//nil, is called with the reply arriving after that, so request can undo
+//what broker has done
+func (c *Conn) requestLate(ctx context.Context, p *proto.Proto, late func(rp *proto.Proto),
+	expectMethods ...uint32) (*proto.Proto, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	rp, ok := <-c.wait
+	reqId := c.nextReqId()
+	p.Fields[proto.ReqIdStr] = reqId
+
+	reply := make(chan *proto.Proto, 1)
+	ok := c.addPending(reqId, func(rp *proto.Proto) {
+		reply <- rp
+	})
+
 	if !ok {
-		return nil, fmt.Errorf("wait channel closed")
+		return nil, ErrConnClosed
 	}
 
-	if rp.Method == proto.Error {
-		return nil, fmt.Errorf("error:%s, code:%s", rp.Body, rp.Fields[proto.CodeStr])
-	} else if rp.Method != expectMethod {
-		return nil, fmt.Errorf("invalid return method %d != %d", rp.Method, expectMethod)
+	if err := c.writeProto(p); err != nil {
+		if c.popPending(reqId) != nil {
+			return nil, err
+		}
+	}
+
+	var rp *proto.Proto
+	select {
+	case rp = <-reply:
+	case <-ctx.Done():
+		if late == nil {
+			c.popPending(reqId)
+		} else {
+			//pending reply is always called, nil if conn closed
+			go func() {
+				if rp := <-reply; rp != nil && rp.Method != proto.Error {
+					late(rp)
+				}
+			}()
+		}
+		return nil, ctx.Err()
 	}
 
-	return rp, nil
+	if rp == nil {
+		return nil, ErrConnClosed
+	} else if rp.Method == proto.Error {
+		return nil, replyError(rp)
+	}
+
+	for _, m := range expectMethods {
+		if rp.Method == m {
+			return rp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid return method %d, expect %v", rp.Method, expectMethods)
 }
 
+//write error closes socket, read loop finds it and reconnects
 func (c *Conn) writeProto(p *proto.Proto) error {
-	buf, err := proto.Marshal(p)
+	c.writeLock.Lock()
+	err := c.encoder.Encode(p)
 	if err != nil {
-		return err
+		c.conn.Close()
 	}
-	c.writeLock.Lock()
-	n, err := c.conn.Write(buf)
 	c.writeLock.Unlock()
 
-	if err != nil {
-		c.close()
-		return err
-	} else if n != len(buf) {
-		c.close()
-		return fmt.Errorf("write short %d != %d", n, len(buf))
+	return err
+}
+
+func (c *Conn) Publish(queue string, routingKey string, body []byte, pubType string) (int64, error) {
+	return c.PublishContext(context.Background(), queue, routingKey, body, pubType)
+}
+
+//PublishContext stops waiting flow resuming or broker reply when ctx is
+//done, msg may still be published if it has been sent
+func (c *Conn) PublishContext(ctx context.Context, queue string, routingKey string,
+	body []byte, pubType string) (int64, error) {
+	return c.PublishWithHeadersContext(ctx, queue, routingKey, nil, body, pubType)
+}
+
+//PublishWithHeaders publishes msg with headers, consumers get them in Delivery
+func (c *Conn) PublishWithHeaders(queue string, routingKey string, headers map[string]string,
+	body []byte, pubType string) (int64, error) {
+	return c.PublishWithHeadersContext(context.Background(), queue, routingKey, headers, body, pubType)
+}
+
+func (c *Conn) PublishWithHeadersContext(ctx context.Context, queue string, routingKey string,
+	headers map[string]string, body []byte, pubType string) (int64, error) {
+	p := &Publishing{queue, routingKey, pubType, headers, body}
+	return c.publish(ctx, p, nil).WaitContext(ctx)
+}
+
+//PublishAsync sends publish without waiting Publish_OK, so many publishes
+//can be pipelined in one conn. confirm, if not nil, is called in the conn
+//read goroutine when broker replies, so it must not block
+func (c *Conn) PublishAsync(queue string, routingKey string, body []byte, pubType string,
+	confirm func(msgId int64, err error)) *PublishFuture {
+	p := &Publishing{queue, routingKey, pubType, nil, body}
+	return c.publish(context.Background(), p, confirm)
+}
+
+//publish injects ctx trace and runs publish interceptors, confirm gets
+//their final result
+func (c *Conn) publish(ctx context.Context, pub *Publishing, confirm func(msgId int64, err error)) *PublishFuture {
+	//trace and interceptors set headers, caller's map may be shared, so
+	//never change it
+	if pub.Headers != nil {
+		headers := make(map[string]string, len(pub.Headers)+1)
+		for k, v := range pub.Headers {
+			headers[k] = v
+		}
+		pub.Headers = headers
 	}
 
-	return nil
+	injectTrace(ctx, pub)
+
+	f := c.publishInvoker()(ctx, pub)
+	if confirm != nil {
+		f.Then(confirm)
+	}
+
+	return f
 }
 
-func (c *Conn) Publish(queue string, routingKey string, body []byte, pubType string) (int64, error) {
-	p := proto.NewPublishProto(queue, routingKey, pubType, body)
+//send is the last invoker of publish interceptor chain
+func (c *Conn) send(ctx context.Context, pub *Publishing) *PublishFuture {
+	f := newPublishFuture(nil)
 
-	c.Lock()
-	defer c.Unlock()
+	p := proto.NewPublishProto(pub.Queue, pub.RoutingKey, pub.PubType, pub.Body)
+	if err := p.P.SetHeaders(pub.Headers); err != nil {
+		f.finish(0, err)
+		return f
+	}
 
-	np, err := c.request(p.P, proto.Publish_OK)
-	if err != nil {
-		return 0, err
+	if err := ctx.Err(); err != nil {
+		f.finish(0, err)
+		return f
 	}
 
-	return strconv.ParseInt(string(np.Body), 10, 64)
+	if err := c.waitFlow(ctx); err != nil {
+		f.finish(0, err)
+		return f
+	}
+
+	reqId := c.nextReqId()
+	p.P.Fields[proto.ReqIdStr] = reqId
+
+	ok := c.addPending(reqId, func(rp *proto.Proto) {
+		if rp == nil {
+			f.finish(0, ErrConnClosed)
+		} else if rp.Method == proto.Error {
+			f.finish(0, replyError(rp))
+		} else if rp.Method != proto.Publish_OK {
+			f.finish(0, fmt.Errorf("invalid return method %d != %d", rp.Method, proto.Publish_OK))
+		} else {
+			msgId, err := strconv.ParseInt(string(rp.Body), 10, 64)
+			f.finish(msgId, err)
+		}
+	})
+
+	if !ok {
+		f.finish(0, ErrConnClosed)
+		return f
+	}
+
+	if err := c.writeProto(p.P); err != nil {
+		if c.popPending(reqId) != nil {
+			f.finish(0, err)
+		}
+	}
+
+	return f
 }
 
 func (c *Conn) Bind(queue string, routingKey string, noAck bool) (*Channel, error) {
-	c.Lock()
-	defer c.Unlock()
+	return c.BindContext(context.Background(), queue, routingKey, noAck)
+}
 
+func (c *Conn) BindContext(ctx context.Context, queue string, routingKey string, noAck bool) (*Channel, error) {
+	c.Lock()
 	ch, ok := c.channels[queue]
 	if !ok {
 		ch = newChannel(c, queue, routingKey, noAck)
@@ -193,13 +711,34 @@ func (c *Conn) Bind(queue string, routingKey string, noAck bool) (*Channel, erro
 	} else {
 		ch.routingKey = routingKey
 		ch.noAck = noAck
+		if !noAck {
+			ch.SetDropPolicy(DropNone)
+		}
 	}
+	c.Unlock()
 
 	p := proto.NewBindProto(queue, routingKey, noAck)
 
-	rp, err := c.request(p.P, proto.Bind_OK)
+	rp, err := c.requestLate(ctx, p.P, func(rp *proto.Proto) {
+		c.Lock()
+		_, bound := c.channels[queue]
+		c.Unlock()
+
+		//bind canceled but broker has done it, msgs pushed would never be acked
+		if !bound {
+			up := proto.NewUnbindProto(queue)
+			c.writeProto(up.P)
+		}
+	}, proto.Bind_OK)
 
 	if err != nil {
+		if !ok {
+			c.Lock()
+			if c.channels[queue] == ch {
+				delete(c.channels, queue)
+			}
+			c.Unlock()
+		}
 		return nil, err
 	}
 
@@ -210,32 +749,36 @@ func (c *Conn) Bind(queue string, routingKey string, noAck bool) (*Channel, erro
 	return ch, nil
 }
 
-func (c *Conn) unbindAll() error {
+func (c *Conn) unbindAll(ctx context.Context) error {
 	c.Lock()
-	defer c.Unlock()
-
+	channels := c.channels
 	c.channels = make(map[string]*Channel)
+	c.Unlock()
+
+	for _, ch := range channels {
+		ch.stop()
+	}
 
 	p := proto.NewUnbindProto("")
 
-	_, err := c.request(p.P, proto.Unbind_OK)
+	_, err := c.request(ctx, p.P, proto.Unbind_OK)
 	return err
 }
 
-func (c *Conn) unbind(queue string) error {
+func (c *Conn) unbind(ctx context.Context, queue string) error {
 	c.Lock()
-	defer c.Unlock()
-
 	_, ok := c.channels[queue]
 	if !ok {
+		c.Unlock()
 		return fmt.Errorf("queue %s not bind", queue)
 	}
 
 	delete(c.channels, queue)
+	c.Unlock()
 
 	p := proto.NewUnbindProto(queue)
 
-	rp, err := c.request(p.P, proto.Unbind_OK)
+	rp, err := c.request(ctx, p.P, proto.Unbind_OK)
 	if err != nil {
 		return err
 	}
@@ -252,3 +795,9 @@ func (c *Conn) ack(queue string, msgId string) error {
 
 	return c.writeProto(p.P)
 }
+
+func (c *Conn) nack(queue string, msgId string, requeue bool) error {
+	p := proto.NewNackProto(queue, msgId, requeue)
+
+	return c.writeProto(p.P)
+}
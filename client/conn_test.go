@@ -0,0 +1,171 @@
+package client_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/siddontang/moonmq/broker"
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishAsync(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	fs := make([]*client.PublishFuture, 0, 100)
+	for i := 0; i < 100; i++ {
+		fs = append(fs, c.PublishAsync("test_queue_async", "", []byte("hello world"), "direct", nil))
+	}
+
+	ids := make(map[int64]struct{}, len(fs))
+	for _, f := range fs {
+		id, err := f.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids[id] = struct{}{}
+	}
+
+	if len(ids) != len(fs) {
+		t.Fatal(len(ids))
+	}
+
+	f := c.PublishAsync("", "", []byte("hello world"), "direct", nil)
+	if _, err := f.Wait(); err == nil {
+		t.Fatal("must error")
+	}
+}
+
+func TestSharedConn(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.Publish("test_queue_shared", "", []byte("hello world"), "direct")
+			errs <- err
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			queue := fmt.Sprintf("test_queue_shared_%d", i)
+			ch, err := c.Bind(queue, "", true)
+			if err == nil {
+				err = ch.Close()
+			}
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	b := mmqtest.NewBroker(t, func(cfg *broker.Config) {
+		cfg.AdminPassword = "admin"
+	})
+
+	cli := b.NewClient(func(cfg *client.Config) {
+		cfg.ReconnectInterval = 50
+	})
+
+	states := make(chan client.ConnState, 16)
+	cli.SetStateCallback(func(c *client.Conn, state client.ConnState, err error) {
+		states <- state
+	})
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	queue := "test_queue_reconnect"
+	ch, err := c.Bind(queue, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := testAdminRequest(b, "DELETE", fmt.Sprintf("/admin/conn?id=%d", testAdminConnId(t, b, queue)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, expect := range []client.ConnState{client.StateDisconnected, client.StateConnected} {
+		select {
+		case state := <-states:
+			if state != expect {
+				t.Fatal(state, expect)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait state timeout", expect)
+		}
+	}
+
+	b.Publish(queue, "", []byte("123"))
+
+	if msg := ch.WaitMsg(2 * time.Second); string(msg) != "123" {
+		t.Fatal(string(msg))
+	}
+}
+
+func testAdminRequest(b *mmqtest.Broker, method string, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.HttpUrl(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth("admin", "admin")
+	return http.DefaultClient.Do(req)
+}
+
+func testAdminConnId(t *testing.T, b *mmqtest.Broker, queue string) int64 {
+	var conns struct {
+		Conns []struct {
+			Id       int64 `json:"id"`
+			Channels []struct {
+				Queue string `json:"queue"`
+			} `json:"channels"`
+		} `json:"conns"`
+	}
+
+	resp, err := testAdminRequest(b, "GET", "/admin/conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, co := range conns.Conns {
+		for _, ch := range co.Channels {
+			if ch.Queue == queue {
+				return co.Id
+			}
+		}
+	}
+
+	t.Fatal("bound conn not found")
+	return 0
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrDeliveryDone = errors.New("delivery has been acked or nacked")
+
+//Delivery is a msg pushed to a consumer, it can be acked or nacked
+//in any worker goroutine, independent of other deliveries. see
+//Conn.Consume before publishing with consumer conn in handler
+type Delivery struct {
+	Queue   string
+	ID      int64
+	Headers map[string]string
+	Body    []byte
+
+	conn  *Conn
+	noAck bool
+	done  int32
+}
+
+func newDelivery(c *Conn, queue string, noAck bool, m *channelMsg) (*Delivery, error) {
+	id, err := strconv.ParseInt(m.ID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Delivery)
+	d.Queue = queue
+	d.ID = id
+	d.Headers = m.Headers
+	d.Body = m.Body
+
+	d.conn = c
+	d.noAck = noAck
+
+	return d, nil
+}
+
+func (d *Delivery) finish() error {
+	if !atomic.CompareAndSwapInt32(&d.done, 0, 1) {
+		return ErrDeliveryDone
+	}
+	return nil
+}
+
+//Ack tells broker the msg is handled, no op for no ack consumer
+func (d *Delivery) Ack() error {
+	if d.noAck {
+		return nil
+	}
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	return d.conn.ack(d.Queue, strconv.FormatInt(d.ID, 10))
+}
+
+//Nack gives up the msg, broker pushes it again, to another consumer if
+//possible, if requeue, otherwise discards it. no op for no ack consumer
+func (d *Delivery) Nack(requeue bool) error {
+	if d.noAck {
+		return nil
+	}
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	return d.conn.nack(d.Queue, strconv.FormatInt(d.ID, 10), requeue)
+}
+
+//Handler handles a delivery, error is only used by auto ack
+type Handler func(d *Delivery) error
+
+type ConsumeOptions struct {
+	//goroutines calling handler concurrently, default 1. broker pushes
+	//the next msg of a queue only after the previous one is acked, so
+	//handlers run in parallel only for no ack consumer
+	Workers int
+
+	NoAck bool
+
+	//ack delivery if handler returns nil, otherwise nack it with requeue,
+	//unless handler has acked or nacked it itself
+	AutoAck bool
+
+	//only for no ack consumer, see Channel.SetDropPolicy
+	DropPolicy DropPolicy
+}
+
+//Consumer calls handler for msgs pushed from a bound queue
+type Consumer struct {
+	c    *Conn
+	ch   *Channel
+	opts ConsumeOptions
+
+	handler Handler
+
+	wg sync.WaitGroup
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+//Consume binds queue and calls handler in opts.Workers goroutines, a conn
+//can consume a queue only once, close consumer to unbind it. an ack
+//consumer gets one msg at a time whatever opts.Workers is, see Workers.
+//
+//pushes and replies share the conn read loop, which blocks when the
+//channel buffer is full, so a no ack handler must not publish or send
+//other requests with the consumer conn, their replies may never be read
+//while the read loop waits handler. use another conn, e.g, Client.Publish
+func (c *Conn) Consume(queue string, routingKey string, handler Handler, opts *ConsumeOptions) (*Consumer, error) {
+	return c.ConsumeContext(context.Background(), queue, routingKey, handler, opts)
+}
+
+//ConsumeContext bounds binding queue with ctx, workers are stopped by Close
+func (c *Conn) ConsumeContext(ctx context.Context, queue string, routingKey string,
+	handler Handler, opts *ConsumeOptions) (*Consumer, error) {
+	var o ConsumeOptions
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Workers <= 0 {
+		o.Workers = 1
+	}
+
+	c.Lock()
+	_, ok := c.channels[queue]
+	c.Unlock()
+
+	if ok {
+		return nil, fmt.Errorf("queue %s already bound", queue)
+	} else if o.DropPolicy != DropNone && !o.NoAck {
+		return nil, ErrDropPolicyAck
+	}
+
+	ch, err := c.BindContext(ctx, queue, routingKey, o.NoAck)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.SetDropPolicy(o.DropPolicy)
+
+	cs := new(Consumer)
+	cs.c = c
+	cs.ch = ch
+	cs.opts = o
+	cs.handler = c.consumeHandler(handler)
+	cs.stop = make(chan struct{})
+
+	for i := 0; i < o.Workers; i++ {
+		cs.wg.Add(1)
+		go cs.work()
+	}
+
+	return cs, nil
+}
+
+func (cs *Consumer) work() {
+	defer cs.wg.Done()
+
+	for {
+		select {
+		case <-cs.stop:
+			if cs.opts.NoAck {
+				cs.drain()
+			}
+			return
+		default:
+		}
+
+		select {
+		case <-cs.stop:
+		case m := <-cs.ch.msg:
+			cs.handle(m)
+		}
+	}
+}
+
+//drain handles msgs left after unbind, no ack msgs are lost otherwise
+func (cs *Consumer) drain() {
+	for {
+		select {
+		case m := <-cs.ch.msg:
+			cs.handle(m)
+		default:
+			return
+		}
+	}
+}
+
+func (cs *Consumer) handle(m *channelMsg) {
+	d, err := newDelivery(cs.c, cs.ch.queue, cs.opts.NoAck, m)
+	if err != nil {
+		return
+	}
+
+	err = cs.handler(d)
+
+	if !cs.opts.AutoAck || atomic.LoadInt32(&d.done) == 1 {
+		return
+	}
+
+	if err == nil {
+		d.Ack()
+	} else {
+		d.Nack(true)
+	}
+}
+
+//Close stops workers after their running handlers return and unbinds queue.
+//msgs waiting ack are pushed to other consumers by broker, buffered no ack
+//msgs are handled before Close returns
+func (cs *Consumer) Close() error {
+	cs.closeOnce.Do(func() {
+		if cs.opts.NoAck {
+			//workers keep reading, so read loop can't be blocked by a
+			//full buffer, no more msgs pushed after unbind returns
+			cs.closeErr = cs.c.unbind(context.Background(), cs.ch.queue)
+			cs.ch.stop()
+			close(cs.stop)
+			cs.wg.Wait()
+		} else {
+			//handlers can still ack before unbinding
+			close(cs.stop)
+			cs.wg.Wait()
+			cs.closeErr = cs.ch.Close()
+		}
+	})
+
+	return cs.closeErr
+}
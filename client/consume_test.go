@@ -0,0 +1,140 @@
+package client_test
+
+import (
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsume(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	queue := "test_queue_consume"
+
+	type result struct {
+		body       string
+		trace      string
+		redelivery bool
+	}
+
+	results := make(chan result, 16)
+	var lock sync.Mutex
+	seen := map[int64]bool{}
+
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		lock.Lock()
+		redelivery := seen[d.ID]
+		seen[d.ID] = true
+		lock.Unlock()
+
+		results <- result{string(d.Body), d.Headers["trace"], redelivery}
+
+		//nack first delivery of msg 1, broker pushes it again
+		if string(d.Body) == "1" && !redelivery {
+			return d.Nack(true)
+		}
+		return d.Ack()
+	}, &client.ConsumeOptions{Workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Consume(queue, "", nil, nil); err == nil {
+		t.Fatal("must fail to consume a queue twice")
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if _, err = c.PublishWithHeaders(queue, "", map[string]string{"trace": body}, []byte(body), "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expects := []result{{"1", "1", false}, {"1", "1", true}, {"2", "2", false}}
+	for _, expect := range expects {
+		select {
+		case r := <-results:
+			if r != expect {
+				t.Fatal(r, expect)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("wait delivery timeout", expect)
+		}
+	}
+
+	if err = cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//auto ack no ack consumer after first consumer closed
+	if _, err = c.Publish(queue, "", []byte("3"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan string, 1)
+	cs, err = c.Consume(queue, "", func(d *client.Delivery) error {
+		done <- string(d.Body)
+		return nil
+	}, &client.ConsumeOptions{NoAck: true, AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	select {
+	case body := <-done:
+		if body != "3" {
+			t.Fatal(body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait delivery timeout")
+	}
+}
+
+func TestConsumeWorkers(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	queue := "test_queue_consume_workers"
+	workers := 4
+
+	//every handler blocks until all workers run a handler concurrently
+	var lock sync.Mutex
+	running := 0
+	all := make(chan struct{})
+	release := make(chan struct{})
+
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		lock.Lock()
+		running++
+		if running == workers {
+			close(all)
+		}
+		lock.Unlock()
+
+		<-release
+		return nil
+	}, &client.ConsumeOptions{Workers: workers, NoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	defer close(release)
+
+	for i := 0; i < workers; i++ {
+		if _, err = c.Publish(queue, "", []byte("1"), "direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-all:
+	case <-time.After(2 * time.Second):
+		lock.Lock()
+		t.Fatalf("%d of %d workers run handler concurrently", running, workers)
+	}
+}
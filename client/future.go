@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrConnClosed = errors.New("conn has been closed")
+
+//PublishFuture is the publisher confirm of an async publish
+type PublishFuture struct {
+	lock sync.Mutex
+
+	done     chan struct{}
+	finished bool
+
+	msgId int64
+	err   error
+
+	callbacks []func(msgId int64, err error)
+}
+
+func newPublishFuture(confirm func(msgId int64, err error)) *PublishFuture {
+	f := new(PublishFuture)
+
+	f.done = make(chan struct{})
+	if confirm != nil {
+		f.callbacks = append(f.callbacks, confirm)
+	}
+
+	return f
+}
+
+//NewFinishedFuture returns a confirmed future, publish interceptors use it
+//to return result without publishing, or after waiting publish themselves
+func NewFinishedFuture(msgId int64, err error) *PublishFuture {
+	f := newPublishFuture(nil)
+	f.finish(msgId, err)
+	return f
+}
+
+//Done is closed when broker confirms the publish or publish fails
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+//Wait blocks until the publish is confirmed and returns the msg id
+func (f *PublishFuture) Wait() (int64, error) {
+	<-f.done
+
+	return f.msgId, f.err
+}
+
+//WaitContext is Wait but returns ctx error if ctx is done before confirm,
+//the publish may still be confirmed later
+func (f *PublishFuture) WaitContext(ctx context.Context) (int64, error) {
+	select {
+	case <-f.done:
+		return f.msgId, f.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+//Then calls cb when publish is confirmed, at once if it has been. cb may be
+//called in conn read goroutine, so it must not block
+func (f *PublishFuture) Then(cb func(msgId int64, err error)) {
+	f.lock.Lock()
+	if !f.finished {
+		f.callbacks = append(f.callbacks, cb)
+		f.lock.Unlock()
+		return
+	}
+	f.lock.Unlock()
+
+	cb(f.msgId, f.err)
+}
+
+func (f *PublishFuture) finish(msgId int64, err error) {
+	f.lock.Lock()
+	f.msgId = msgId
+	f.err = err
+	f.finished = true
+
+	callbacks := f.callbacks
+	f.callbacks = nil
+	f.lock.Unlock()
+
+	//waiters see result after callbacks, e.g, interceptors observing it
+	for _, cb := range callbacks {
+		cb(msgId, err)
+	}
+
+	close(f.done)
+}
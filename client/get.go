@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/proto"
+	"strconv"
+	"time"
+)
+
+//Message is a msg pulled by get
+type Message struct {
+	ID    int64
+	Queue string
+	Body  []byte
+}
+
+//Get pulls one msg with no ack, waits at most timeout if queue is empty,
+//returns nil if no msg
+func (c *Conn) Get(queue string, timeout time.Duration) (*Message, error) {
+	return c.GetContext(context.Background(), queue, timeout)
+}
+
+func (c *Conn) GetContext(ctx context.Context, queue string, timeout time.Duration) (*Message, error) {
+	ms, err := c.GetMsgsContext(ctx, queue, "", 1, timeout, true)
+	if err != nil || len(ms) == 0 {
+		return nil, err
+	}
+
+	return ms[0], nil
+}
+
+//GetMsgs pulls at most count msgs without binding queue, waits at most
+//timeout for the first msg if queue is empty. If not noAck, only one msg
+//is leased and must be acked with Ack before next get of the queue, or it
+//will be pushed again when conn closed
+func (c *Conn) GetMsgs(queue string, routingKey string, count int, timeout time.Duration, noAck bool) ([]*Message, error) {
+	return c.GetMsgsContext(context.Background(), queue, routingKey, count, timeout, noAck)
+}
+
+//GetMsgsContext returns ctx error if ctx is done before broker replies,
+//a msg leased after that is nacked to be pushed again
+func (c *Conn) GetMsgsContext(ctx context.Context, queue string, routingKey string, count int,
+	timeout time.Duration, noAck bool) ([]*Message, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		//don't let broker wait longer than caller
+		if d := deadline.Sub(time.Now()); d < timeout {
+			timeout = d
+		}
+	}
+
+	p := proto.NewGetProto(queue, routingKey, noAck, timeout, count)
+
+	var late func(rp *proto.Proto)
+	if !noAck {
+		late = func(rp *proto.Proto) {
+			if rp.Method != proto.Get_OK {
+				return
+			}
+
+			gms, err := proto.DecodeGetMsgs(rp.Body)
+			if err != nil {
+				return
+			}
+
+			for _, gm := range gms {
+				c.nack(queue, strconv.FormatInt(gm.MsgId, 10), true)
+			}
+		}
+	}
+
+	rp, err := c.requestLate(ctx, p.P, late, proto.Get_OK, proto.Get_Empty)
+	if err != nil {
+		return nil, err
+	}
+
+	if rp.Method == proto.Get_Empty {
+		return nil, nil
+	}
+
+	gms, err := proto.DecodeGetMsgs(rp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := make([]*Message, 0, len(gms))
+	for _, gm := range gms {
+		ms = append(ms, &Message{gm.MsgId, queue, gm.Body})
+	}
+
+	return ms, nil
+}
+
+//Ack acks msg got with GetMsgs
+func (c *Conn) Ack(queue string, msgId int64) error {
+	if len(queue) == 0 {
+		return fmt.Errorf("queue must supplied")
+	}
+
+	return c.ack(queue, strconv.FormatInt(msgId, 10))
+}
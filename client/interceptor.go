@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+)
+
+//Publishing is a msg to publish, publish interceptors can modify it
+type Publishing struct {
+	Queue      string
+	RoutingKey string
+	PubType    string
+	Headers    map[string]string
+	Body       []byte
+}
+
+//SetHeader sets a header, creating headers map if nil
+func (p *Publishing) SetHeader(key string, value string) {
+	if p.Headers == nil {
+		p.Headers = make(map[string]string)
+	}
+	p.Headers[key] = value
+}
+
+//PublishInvoker publishes p, sync publishes wait returned future
+type PublishInvoker func(ctx context.Context, p *Publishing) *PublishFuture
+
+//PublishInterceptor wraps every publish of conn, including async ones.
+//it calls next to go on, and can observe result with PublishFuture.Then,
+//or return NewFinishedFuture to replace result or skip publishing
+type PublishInterceptor func(ctx context.Context, p *Publishing, next PublishInvoker) *PublishFuture
+
+//ConsumeInterceptor wraps every handler call of Consume, it calls next
+//to go on, and can modify delivery and returned error
+type ConsumeInterceptor func(d *Delivery, next Handler) error
+
+//UsePublish appends publish interceptors for all conns, the first one is
+//the outermost
+func (c *Client) UsePublish(is ...PublishInterceptor) {
+	c.Lock()
+	c.publishInterceptors = append(c.publishInterceptors, is...)
+	c.Unlock()
+}
+
+//UseConsume appends consume interceptors for all conns, consumers created
+//before are not affected
+func (c *Client) UseConsume(is ...ConsumeInterceptor) {
+	c.Lock()
+	c.consumeInterceptors = append(c.consumeInterceptors, is...)
+	c.Unlock()
+}
+
+//UsePublish appends publish interceptors of conn, they run after client
+//ones until conn is closed
+func (c *Conn) UsePublish(is ...PublishInterceptor) {
+	c.Lock()
+	c.publishInterceptors = append(c.publishInterceptors, is...)
+	c.Unlock()
+}
+
+//UseConsume appends consume interceptors of conn, they run after client
+//ones until conn is closed
+func (c *Conn) UseConsume(is ...ConsumeInterceptor) {
+	c.Lock()
+	c.consumeInterceptors = append(c.consumeInterceptors, is...)
+	c.Unlock()
+}
+
+func (c *Conn) publishInvoker() PublishInvoker {
+	c.client.Lock()
+	is := append([]PublishInterceptor{}, c.client.publishInterceptors...)
+	c.client.Unlock()
+
+	c.Lock()
+	is = append(is, c.publishInterceptors...)
+	c.Unlock()
+
+	invoker := PublishInvoker(c.send)
+	for i := len(is) - 1; i >= 0; i-- {
+		interceptor, next := is[i], invoker
+		invoker = func(ctx context.Context, p *Publishing) *PublishFuture {
+			return interceptor(ctx, p, next)
+		}
+	}
+
+	return invoker
+}
+
+func (c *Conn) consumeHandler(handler Handler) Handler {
+	c.client.Lock()
+	is := append([]ConsumeInterceptor{}, c.client.consumeInterceptors...)
+	c.client.Unlock()
+
+	c.Lock()
+	is = append(is, c.consumeInterceptors...)
+	c.Unlock()
+
+	for i := len(is) - 1; i >= 0; i-- {
+		interceptor, next := is[i], handler
+		handler = func(d *Delivery) error {
+			return interceptor(d, next)
+		}
+	}
+
+	return handler
+}
@@ -0,0 +1,161 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"github.com/siddontang/moonmq/proto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptor(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	cli := b.NewClient()
+
+	var lock sync.Mutex
+	var events []string
+	event := func(e string) {
+		lock.Lock()
+		events = append(events, e)
+		lock.Unlock()
+	}
+
+	blocked := fmt.Errorf("blocked")
+
+	cli.UsePublish(func(ctx context.Context, p *client.Publishing, next client.PublishInvoker) *client.PublishFuture {
+		if p.Queue == "test_queue_blocked" {
+			return client.NewFinishedFuture(0, blocked)
+		}
+
+		p.SetHeader("trace", "1")
+		event("client publish")
+		f := next(ctx, p)
+		f.Then(func(msgId int64, err error) {
+			if err != nil {
+				event("publish error")
+			}
+		})
+		return f
+	})
+
+	cli.UseConsume(func(d *client.Delivery, next client.Handler) error {
+		event("client consume " + d.Headers["trace"])
+		return next(d)
+	})
+
+	c, err := cli.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.UsePublish(func(ctx context.Context, p *client.Publishing, next client.PublishInvoker) *client.PublishFuture {
+		event("conn publish")
+		p.Body = bytes.ToUpper(p.Body)
+		return next(ctx, p)
+	})
+
+	c.UseConsume(func(d *client.Delivery, next client.Handler) error {
+		event("conn consume")
+		return next(d)
+	})
+
+	queue := "test_queue_interceptor"
+
+	bodies := make(chan string, 1)
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		bodies <- string(d.Body)
+		return nil
+	}, &client.ConsumeOptions{NoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	if _, err = c.Publish(queue, "", []byte("hello"), "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-bodies:
+		if body != "HELLO" {
+			t.Fatal(body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait delivery timeout")
+	}
+
+	//async publish is intercepted too, error is observed
+	if _, err = c.PublishAsync("", "", []byte("hello"), "direct", nil).Wait(); err == nil {
+		t.Fatal("must fail to publish empty queue")
+	}
+
+	if _, err = c.Publish("test_queue_blocked", "", []byte("hello"), "direct"); err != blocked {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	got := strings.Join(events, ",")
+	lock.Unlock()
+
+	expect := "client publish,conn publish,client consume 1,conn consume,client publish,conn publish,publish error"
+	if got != expect {
+		t.Fatal(got)
+	}
+}
+
+func TestPublishSharedHeaders(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	c := testConn(t, b)
+	defer c.Close()
+
+	c.UsePublish(func(ctx context.Context, p *client.Publishing, next client.PublishInvoker) *client.PublishFuture {
+		p.SetHeader("intercepted", "1")
+		return next(ctx, p)
+	})
+
+	queue := "test_queue_shared_headers"
+	headers := map[string]string{"k": "v"}
+
+	traces := []proto.TraceContext{proto.NewTraceContext(), proto.NewTraceContext()}
+	for _, tc := range traces {
+		ctx := client.ContextWithTrace(context.Background(), tc)
+		if _, err := c.PublishWithHeadersContext(ctx, queue, "", headers, []byte("123"), "direct"); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(headers) != 1 || headers["k"] != "v" {
+			t.Fatal("caller headers changed", headers)
+		}
+	}
+
+	ds := make(chan *client.Delivery, len(traces))
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		ds <- d
+		return nil
+	}, &client.ConsumeOptions{NoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	for _, tc := range traces {
+		var d *client.Delivery
+		select {
+		case d = <-ds:
+		case <-time.After(2 * time.Second):
+			t.Fatal("wait delivery timeout")
+		}
+
+		if d.Headers["intercepted"] != "1" {
+			t.Fatal(d.Headers)
+		} else if got, ok := d.Trace(); !ok || got.TraceID != tc.TraceID {
+			t.Fatal(d.Headers, tc)
+		}
+	}
+}
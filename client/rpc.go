@@ -0,0 +1,276 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/siddontang/moonmq/proto"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	rpc request is a direct msg with headers
+
+	reply_to: queue to publish reply
+	correlation_id: echoed in reply to match call
+
+	reply is published to reply_to queue with correlation_id, and rpc_error
+	if handler failed, body is error message then. broker forbids empty
+	msg, so reply can't be empty either.
+*/
+
+const (
+	ReplyToHeader       = "reply_to"
+	CorrelationIdHeader = "correlation_id"
+	RPCErrorHeader      = "rpc_error"
+)
+
+var ErrRPCClosed = errors.New("rpc has been closed")
+
+//RemoteError is error returned by rpc server handler
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc remote error:%s", e.Message)
+}
+
+//RPC calls rpc servers, replies are consumed from a reply queue only
+//bound by its own conn
+type RPC struct {
+	conn     *Conn
+	queue    string
+	consumer *Consumer
+
+	seq uint64
+
+	lock    sync.Mutex
+	pending map[string]chan *Delivery
+	closed  bool
+}
+
+func randomQueue(prefix string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return prefix + hex.EncodeToString(buf), nil
+}
+
+//NewRPC creates a conn and binds a random reply queue
+func (c *Client) NewRPC() (*RPC, error) {
+	queue, err := randomQueue("rpc_reply_")
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(RPC)
+	r.queue = queue
+	r.pending = make(map[string]chan *Delivery)
+
+	if r.conn, err = c.Get(); err != nil {
+		return nil, err
+	}
+
+	r.consumer, err = r.conn.Consume(queue, "", r.handleReply, &ConsumeOptions{NoAck: true})
+	if err != nil {
+		r.conn.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+//ReplyQueue returns queue replies are published to
+func (r *RPC) ReplyQueue() string {
+	return r.queue
+}
+
+func (r *RPC) handleReply(d *Delivery) error {
+	id := d.Headers[CorrelationIdHeader]
+
+	r.lock.Lock()
+	reply, ok := r.pending[id]
+	if ok {
+		delete(r.pending, id)
+	}
+	r.lock.Unlock()
+
+	//else call has timed out
+	if ok {
+		reply <- d
+	}
+
+	return nil
+}
+
+//Call publishes body to queue and waits reply at most timeout
+func (r *RPC) Call(queue string, routingKey string, body []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return r.CallContext(ctx, queue, routingKey, body)
+}
+
+//CallContext publishes body to queue and waits reply until ctx is done
+func (r *RPC) CallContext(ctx context.Context, queue string, routingKey string, body []byte) ([]byte, error) {
+	d, err := r.CallDelivery(ctx, queue, routingKey, nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Body, nil
+}
+
+//CallDelivery publishes body with extra headers and returns the reply
+//delivery, so reply headers can be read
+func (r *RPC) CallDelivery(ctx context.Context, queue string, routingKey string,
+	headers map[string]string, body []byte) (*Delivery, error) {
+	id := strconv.FormatUint(atomic.AddUint64(&r.seq, 1), 10)
+
+	hs := make(map[string]string, len(headers)+2)
+	for k, v := range headers {
+		hs[k] = v
+	}
+	hs[ReplyToHeader] = r.queue
+	hs[CorrelationIdHeader] = id
+
+	reply := make(chan *Delivery, 1)
+
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil, ErrRPCClosed
+	}
+	r.pending[id] = reply
+	r.lock.Unlock()
+
+	if _, err := r.conn.PublishWithHeadersContext(ctx, queue, routingKey, hs, body, proto.DirectPubTypeStr); err != nil {
+		r.removePending(id)
+		return nil, err
+	}
+
+	select {
+	case d := <-reply:
+		if d == nil {
+			return nil, ErrRPCClosed
+		} else if _, ok := d.Headers[RPCErrorHeader]; ok {
+			return nil, &RemoteError{d.Headers[RPCErrorHeader]}
+		}
+		return d, nil
+	case <-ctx.Done():
+		r.removePending(id)
+		return nil, ctx.Err()
+	}
+}
+
+func (r *RPC) removePending(id string) {
+	r.lock.Lock()
+	delete(r.pending, id)
+	r.lock.Unlock()
+}
+
+//Close fails waiting calls and closes conn
+func (r *RPC) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	pending := r.pending
+	r.pending = map[string]chan *Delivery{}
+	r.lock.Unlock()
+
+	for _, reply := range pending {
+		reply <- nil
+	}
+
+	err := r.consumer.Close()
+	r.conn.Close()
+
+	return err
+}
+
+//RPCHandler returns reply body, or error sent to caller as RemoteError
+type RPCHandler func(d *Delivery) ([]byte, error)
+
+//RPCServer consumes a request queue and publishes replies to reply_to queue
+type RPCServer struct {
+	client   *Client
+	conn     *Conn
+	consumer *Consumer
+	handler  RPCHandler
+}
+
+//ServeRPC consumes queue with opts, requests are acked after reply is
+//published, or nacked to be handled again if publishing reply fails,
+//unless opts.NoAck
+func (c *Client) ServeRPC(queue string, routingKey string, handler RPCHandler, opts *ConsumeOptions) (*RPCServer, error) {
+	var o ConsumeOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.AutoAck = true
+
+	s := new(RPCServer)
+	s.client = c
+	s.handler = handler
+
+	var err error
+	if s.conn, err = c.Get(); err != nil {
+		return nil, err
+	}
+
+	if s.consumer, err = s.conn.Consume(queue, routingKey, s.handle, &o); err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *RPCServer) handle(d *Delivery) error {
+	body, err := s.handler(d)
+
+	replyTo := d.Headers[ReplyToHeader]
+	if len(replyTo) == 0 {
+		//nobody waits reply
+		return nil
+	}
+
+	headers := map[string]string{
+		CorrelationIdHeader: d.Headers[CorrelationIdHeader],
+	}
+
+	if err == nil && len(body) == 0 {
+		err = fmt.Errorf("empty reply")
+	}
+
+	if err != nil {
+		headers[RPCErrorHeader] = err.Error()
+		body = []byte(err.Error())
+		if len(body) == 0 {
+			body = []byte("error")
+		}
+	}
+
+	//reply with pooled conns, consumer conn may be blocked by pushes
+	_, err = s.client.PublishWithHeadersContext(d.Context(), replyTo, "", headers, body, proto.DirectPubTypeStr)
+	return err
+}
+
+//Close waits running handlers and unbinds request queue
+func (s *RPCServer) Close() error {
+	err := s.consumer.Close()
+	s.conn.Close()
+
+	return err
+}
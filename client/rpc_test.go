@@ -0,0 +1,63 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/client"
+	"github.com/siddontang/moonmq/mmqtest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRPC(t *testing.T) {
+	b := mmqtest.NewBroker(t)
+	cli := b.Client
+
+	queue := "test_queue_rpc"
+
+	s, err := cli.ServeRPC(queue, "", func(d *client.Delivery) ([]byte, error) {
+		if string(d.Body) == "fail" {
+			return nil, fmt.Errorf("failed")
+		}
+		return bytes.ToUpper(d.Body), nil
+	}, &client.ConsumeOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r, err := cli.NewRPC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("hello %d", i)
+			if reply, err := r.Call(queue, "", []byte(body), 2*time.Second); err != nil {
+				t.Error(err)
+			} else if string(reply) != strings.ToUpper(body) {
+				t.Error(string(reply))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err = r.Call(queue, "", []byte("fail"), 2*time.Second); err == nil {
+		t.Fatal("must fail")
+	} else if e, ok := err.(*client.RemoteError); !ok || e.Message != "failed" {
+		t.Fatal(err)
+	}
+
+	//no server
+	if _, err = r.Call(queue+"_none", "", []byte("hello"), 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package client
+
+//ConnState is passed to state callback when conn state changes
+type ConnState int
+
+const (
+	//conn reconnected and all channels bound again, err is the first
+	//rebind error if any
+	StateConnected ConnState = iota
+	//conn lost socket and will reconnect, err is the read error
+	StateDisconnected
+	//broker is shutting down, conn will be disconnected soon
+	StateShutdown
+	//conn is closed and won't reconnect
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateShutdown:
+		return "shutdown"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+//StateCallback is called in conn internal goroutines, it must not block,
+//nor call conn methods waiting broker reply
+type StateCallback func(c *Conn, state ConnState, err error)
+
+//SetStateCallback sets callback for state changes of all conns
+func (c *Client) SetStateCallback(f StateCallback) {
+	c.Lock()
+	c.stateCallback = f
+	c.Unlock()
+}
+
+func (c *Client) notifyState(co *Conn, state ConnState, err error) {
+	c.Lock()
+	f := c.stateCallback
+	c.Unlock()
+
+	if f != nil {
+		f(co, state, err)
+	}
+}
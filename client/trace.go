@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"github.com/siddontang/moonmq/proto"
+)
+
+/*
+	trace context is carried in msg header traceparent, see proto/trace.go
+
+	publish with a ctx from ContextWithTrace sets traceparent if msg hasn't
+	one, consumer gets it with Delivery.Context, so publishing with that ctx
+	in handler continues the trace.
+*/
+
+type traceKey struct{}
+
+//ContextWithTrace returns ctx carrying trace context to inject in publishes
+func ContextWithTrace(ctx context.Context, tc proto.TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+//TraceFromContext returns valid trace context carried by ctx
+func TraceFromContext(ctx context.Context) (proto.TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(proto.TraceContext)
+	if !ok || !tc.Valid() {
+		return proto.TraceContext{}, false
+	}
+
+	return tc, true
+}
+
+func injectTrace(ctx context.Context, p *Publishing) {
+	if _, ok := p.Headers[proto.TraceparentHeader]; ok {
+		return
+	}
+
+	if tc, ok := TraceFromContext(ctx); ok {
+		p.SetHeader(proto.TraceparentHeader, tc.String())
+	}
+}
+
+//Trace returns trace context of delivery, set by broker deliver span or
+//publisher
+func (d *Delivery) Trace() (proto.TraceContext, bool) {
+	return proto.TraceFromHeaders(d.Headers)
+}
+
+//Context returns a background context carrying delivery trace context
+func (d *Delivery) Context() context.Context {
+	ctx := context.Background()
+	if tc, ok := d.Trace(); ok {
+		ctx = ContextWithTrace(ctx, tc)
+	}
+
+	return ctx
+}
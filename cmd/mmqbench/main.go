@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/siddontang/moonmq/broker"
+	"github.com/siddontang/moonmq/client"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	mmqbench runs publishers and consumers against a broker, or an in-process
+	broker with mem store if addr is empty, and reports throughput and latency.
+
+	publish latency is the round trip of one publish, end to end latency is
+	from publishing to consuming, every msg body begins with send time.
+*/
+
+var addr = flag.String("addr", "", "moonmq broker address, start an in-process broker if empty")
+var queue = flag.String("queue", "bench_queue", "queue to publish and consume")
+var publishers = flag.Int("publishers", 1, "publisher number")
+var consumers = flag.Int("consumers", 1, "consumer number")
+var number = flag.Int("n", 10000, "msgs every publisher publishes")
+var size = flag.Int("size", 128, "msg body size, at least 8")
+var pubType = flag.String("type", "direct", "publish type, direct or fanout")
+var ack = flag.Bool("ack", false, "consumers ack every msg, otherwise bind with no ack")
+var async = flag.Bool("async", false, "pipeline publishes in one conn per publisher")
+var keys = flag.String("routing_keys", "", "comma separated routing keys, publishers and consumers use them in turn")
+var idle = flag.Int("idle", 2, "seconds consumers wait for more msgs after publishers finish")
+
+type stats struct {
+	sync.Mutex
+
+	latencies []time.Duration
+	bytes     int64
+}
+
+func (s *stats) add(d time.Duration, n int) {
+	s.Lock()
+	s.latencies = append(s.latencies, d)
+	s.bytes += int64(n)
+	s.Unlock()
+}
+
+func (s *stats) report(name string, elapsed time.Duration) {
+	n := len(s.latencies)
+	if n == 0 {
+		fmt.Printf("%s: no msgs\n", name)
+		return
+	}
+
+	sort.Sort(durations(s.latencies))
+
+	p := func(q float64) time.Duration {
+		i := int(q * float64(n))
+		if i >= n {
+			i = n - 1
+		}
+		return s.latencies[i]
+	}
+
+	secs := elapsed.Seconds()
+	fmt.Printf("%s: %d msgs in %v, %.0f msg/s, %.2f MB/s\n", name, n, elapsed,
+		float64(n)/secs, float64(s.bytes)/secs/1024/1024)
+	fmt.Printf("  latency p50 %v, p90 %v, p99 %v, max %v\n", p(0.5), p(0.9), p(0.99), s.latencies[n-1])
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func routingKey(keys []string, i int) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[i%len(keys)]
+}
+
+func startBroker() (*broker.App, error) {
+	cfg := broker.NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = ""
+	cfg.MaxQueueSize = 0
+	cfg.MessageTimeout = 0
+
+	app, err := broker.NewAppWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	go app.Run()
+
+	return app, nil
+}
+
+func publish(c *client.Client, id int, keys []string, s *stats) error {
+	conn, err := c.Get()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	body := make([]byte, *size)
+
+	var wg sync.WaitGroup
+	var firstErr atomic.Value
+
+	for i := 0; i < *number; i++ {
+		key := routingKey(keys, id+i)
+
+		start := time.Now()
+		binary.BigEndian.PutUint64(body, uint64(start.UnixNano()))
+
+		if !*async {
+			if _, err = conn.Publish(*queue, key, body, *pubType); err != nil {
+				return err
+			}
+			s.add(time.Now().Sub(start), len(body))
+			continue
+		}
+
+		wg.Add(1)
+		conn.PublishAsync(*queue, key, body, *pubType, func(msgId int64, err error) {
+			if err != nil {
+				firstErr.Store(err)
+			} else {
+				s.add(time.Now().Sub(start), len(body))
+			}
+			wg.Done()
+		})
+	}
+
+	wg.Wait()
+
+	if err, ok := firstErr.Load().(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+func consume(c *client.Client, id int, keys []string, s *stats, ready *sync.WaitGroup, done chan struct{}) error {
+	conn, err := c.Get()
+	if err != nil {
+		ready.Done()
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Bind(*queue, routingKey(keys, id), !*ack)
+	ready.Done()
+	if err != nil {
+		return err
+	}
+
+	var idleSince time.Time
+	for {
+		body := ch.WaitMsg(100 * time.Millisecond)
+		if body == nil {
+			select {
+			case <-done:
+				if idleSince.IsZero() {
+					idleSince = time.Now()
+				} else if time.Now().Sub(idleSince) > time.Duration(*idle)*time.Second {
+					return nil
+				}
+			default:
+			}
+			continue
+		}
+
+		idleSince = time.Time{}
+
+		if len(body) >= 8 {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+			s.add(time.Now().Sub(sent), len(body))
+		}
+
+		if *ack {
+			if err = ch.Ack(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *size < 8 {
+		*size = 8
+	}
+
+	var ks []string
+	if len(*keys) > 0 {
+		ks = strings.Split(*keys, ",")
+	}
+
+	brokerAddr := *addr
+	if len(brokerAddr) == 0 {
+		app, err := startBroker()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "start broker error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer app.Close()
+
+		brokerAddr = app.Addr()
+	}
+
+	cfg := client.NewDefaultConfig()
+	cfg.BrokerAddr = brokerAddr
+	cfg.IdleConns = *publishers + *consumers
+	cfg.MaxQueueSize = 1024
+
+	c, err := client.NewClientWithConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create client error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	fmt.Printf("%d publishers, %d consumers, %d msgs per publisher, %d bytes, %s, ack %v, async %v\n",
+		*publishers, *consumers, *number, *size, *pubType, *ack, *async)
+
+	pubStats := new(stats)
+	conStats := new(stats)
+
+	pubDone := make(chan struct{})
+	var ready sync.WaitGroup
+	var conWg sync.WaitGroup
+
+	for i := 0; i < *consumers; i++ {
+		ready.Add(1)
+		conWg.Add(1)
+		go func(i int) {
+			defer conWg.Done()
+			if err := consume(c, i, ks, conStats, &ready, pubDone); err != nil {
+				fmt.Fprintf(os.Stderr, "consumer %d error: %s\n", i, err.Error())
+			}
+		}(i)
+	}
+
+	ready.Wait()
+
+	start := time.Now()
+
+	var pubWg sync.WaitGroup
+	for i := 0; i < *publishers; i++ {
+		pubWg.Add(1)
+		go func(i int) {
+			defer pubWg.Done()
+			if err := publish(c, i, ks, pubStats); err != nil {
+				fmt.Fprintf(os.Stderr, "publisher %d error: %s\n", i, err.Error())
+			}
+		}(i)
+	}
+
+	pubWg.Wait()
+	pubElapsed := time.Now().Sub(start)
+	close(pubDone)
+
+	conWg.Wait()
+	//consumers waited idle seconds at last
+	conElapsed := time.Now().Sub(start) - time.Duration(*idle)*time.Second
+	if conElapsed < pubElapsed {
+		conElapsed = pubElapsed
+	}
+
+	pubStats.report("publish", pubElapsed)
+	conStats.report("consume", conElapsed)
+
+	//every consumer gets all fanout msgs, direct msgs without matched consumer are discarded
+	expected := len(pubStats.latencies)
+	if *pubType == "fanout" {
+		expected *= *consumers
+	}
+
+	if n := len(conStats.latencies); n < expected {
+		fmt.Printf("consumed %d of %d msgs expected\n", n, expected)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+func httpDo(method string, path string) ([]byte, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", *httpAddr, path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*adminPassword) > 0 {
+		req.SetBasicAuth("admin", *adminPassword)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	return body, nil
+}
+
+func httpGetJson(path string, v interface{}) error {
+	body, err := httpDo("GET", path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+type channelInfo struct {
+	Queue      string `json:"queue"`
+	RoutingKey string `json:"routing_key"`
+	NoAck      bool   `json:"no_ack"`
+}
+
+type queueInfo struct {
+	Name         string         `json:"name"`
+	Depth        int            `json:"depth"`
+	WaitingAckId int64          `json:"waiting_ack_id"`
+	Channels     []*channelInfo `json:"channels"`
+}
+
+func queuePath(path string, queue string) string {
+	return fmt.Sprintf("%s?name=%s", path, url.QueryEscape(queue))
+}
+
+func runQueues(args []string) error {
+	fs := newFlagSet("queues")
+	fs.Parse(args)
+
+	var r struct {
+		Queues []*queueInfo `json:"queues"`
+	}
+
+	if err := httpGetJson("/admin/queues", &r); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDEPTH\tWAITING ACK\tCHANNELS")
+	for _, q := range r.Queues {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", q.Name, q.Depth, q.WaitingAckId, len(q.Channels))
+	}
+
+	return w.Flush()
+}
+
+func runInspect(args []string) error {
+	fs := newFlagSet("inspect")
+	queue := fs.String("queue", "", "queue to inspect")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	var q queueInfo
+	if err := httpGetJson(queuePath("/admin/queue", *queue), &q); err != nil {
+		return err
+	}
+
+	fmt.Printf("name: %s\ndepth: %d\nwaiting ack: %d\nchannels:\n", q.Name, q.Depth, q.WaitingAckId)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  ROUTING KEY\tNO ACK")
+	for _, ch := range q.Channels {
+		fmt.Fprintf(w, "  %s\t%v\n", ch.RoutingKey, ch.NoAck)
+	}
+
+	return w.Flush()
+}
+
+func runPeek(args []string) error {
+	fs := newFlagSet("peek")
+	queue := fs.String("queue", "", "queue to peek")
+	count := fs.Int("count", 1, "max msgs to print")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	var r struct {
+		Msgs []json.RawMessage `json:"msgs"`
+	}
+
+	path := fmt.Sprintf("%s&count=%d", queuePath("/admin/queue/peek", *queue), *count)
+	if err := httpGetJson(path, &r); err != nil {
+		return err
+	}
+
+	for _, m := range r.Msgs {
+		fmt.Printf("%s\n", m)
+	}
+
+	return nil
+}
+
+func runPurge(args []string) error {
+	fs := newFlagSet("purge")
+	queue := fs.String("queue", "", "queue to purge")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	_, err := httpDo("POST", queuePath("/admin/queue/purge", *queue))
+	return err
+}
+
+func runStats(args []string) error {
+	fs := newFlagSet("stats")
+	fs.Parse(args)
+
+	body, err := httpDo("GET", "/metrics")
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(body)
+	return err
+}
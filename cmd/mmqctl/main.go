@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/siddontang/moonmq/client"
+	"os"
+	"sort"
+)
+
+/*
+	mmqctl [-addr xxx] [-http_addr xxx] [-admin_password xxx] command [command flags]
+
+	msg commands use broker tcp addr, except ack mode consume, ack and nack,
+	which use http leases, so a msg can be acked by another mmqctl process.
+	queue commands use broker admin http api, which needs admin_password
+	configured in broker.
+*/
+
+var addr = flag.String("addr", "127.0.0.1:11181", "moonmq broker address")
+var httpAddr = flag.String("http_addr", "127.0.0.1:11180", "moonmq broker http address")
+var adminPassword = flag.String("admin_password", "", "moonmq broker admin api password")
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"publish": {"publish msg from stdin or file", runPublish},
+	"consume": {"get msgs and print them", runConsume},
+	"tail":    {"bind queue and print msgs until interrupted", runTail},
+	"ack":     {"ack msg leased by consume -ack", runAck},
+	"nack":    {"give up msg leased by consume -ack, it will be pushed again", runNack},
+	"queues":  {"list queues", runQueues},
+	"inspect": {"inspect queue", runInspect},
+	"peek":    {"print head msgs of queue without consuming them", runPeek},
+	"purge":   {"delete all msgs of queue", runPurge},
+	"stats":   {"dump broker metrics", runStats},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mmqctl [flags] command [command flags]\n\nflags:\n")
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrun mmqctl command -h for command flags\n")
+}
+
+func newClient() (*client.Client, error) {
+	cfg := client.NewDefaultConfig()
+	cfg.BrokerAddr = *addr
+
+	return client.NewClientWithConfig(cfg)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid command %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s error: %s\n", flag.Arg(0), err.Error())
+		os.Exit(1)
+	}
+}
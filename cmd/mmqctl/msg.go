@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+func checkQueue(queue string) error {
+	if len(queue) == 0 {
+		return fmt.Errorf("queue must set")
+	}
+	return nil
+}
+
+func runPublish(args []string) error {
+	fs := newFlagSet("publish")
+	queue := fs.String("queue", "", "queue to publish")
+	routingKey := fs.String("routing_key", "", "msg routing key")
+	pubType := fs.String("type", "direct", "publish type, direct or fanout")
+	file := fs.String("file", "", "read msg from file, stdin if empty")
+	lines := fs.Bool("lines", false, "publish every line as a msg")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if len(*file) > 0 {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	publish := func(body []byte) error {
+		id, err := c.Publish(*queue, *routingKey, body, *pubType)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(id)
+		return nil
+	}
+
+	if !*lines {
+		body, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+
+		return publish(body)
+	}
+
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		if err = publish(s.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
+
+func printMsg(id int64, body []byte, showId bool) {
+	if showId {
+		fmt.Printf("%d\t%s\n", id, body)
+	} else {
+		fmt.Printf("%s\n", body)
+	}
+}
+
+func runConsume(args []string) error {
+	fs := newFlagSet("consume")
+	queue := fs.String("queue", "", "queue to consume")
+	routingKey := fs.String("routing_key", "", "routing key to match")
+	count := fs.Int("count", 1, "max msgs to get")
+	timeout := fs.Int("timeout", 0, "milliseconds to wait if queue is empty")
+	ack := fs.Bool("ack", false, "lease one msg which must be acked or nacked later")
+	showId := fs.Bool("id", false, "print msg id before body")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	if *ack {
+		return consumeLease(*queue, *routingKey, *timeout)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	conn, err := c.Get()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ms, err := conn.GetMsgs(*queue, *routingKey, *count, time.Duration(*timeout)*time.Millisecond, true)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		printMsg(m.ID, m.Body, *showId)
+	}
+
+	return nil
+}
+
+//tcp lease is dropped when conn closes, so use http lease
+func consumeLease(queue string, routingKey string, timeout int) error {
+	v := url.Values{}
+	v.Set("queue", queue)
+	v.Set("routing_key", routingKey)
+	v.Set("ack", "1")
+	v.Set("timeout", fmt.Sprintf("%d", timeout))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/msg?%s", *httpAddr, v.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	fmt.Fprintf(os.Stderr, "msg %s leased for %s seconds\n",
+		resp.Header.Get("X-Moonmq-Msg-Id"), resp.Header.Get("X-Moonmq-Lease-Timeout"))
+	fmt.Printf("%s\n", body)
+
+	return nil
+}
+
+func runTail(args []string) error {
+	fs := newFlagSet("tail")
+	queue := fs.String("queue", "", "queue to bind")
+	routingKey := fs.String("routing_key", "", "routing key to bind")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	conn, err := c.Get()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Bind(*queue, *routingKey, true)
+	if err != nil {
+		return err
+	}
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-sc:
+			return nil
+		default:
+		}
+
+		if body := ch.WaitMsg(time.Second); body != nil {
+			fmt.Printf("%s\n", body)
+		}
+	}
+}
+
+func leaseRequest(action string, args []string) error {
+	fs := newFlagSet(action)
+	queue := fs.String("queue", "", "queue of msg")
+	id := fs.Int64("id", 0, "msg id printed by consume -ack")
+	fs.Parse(args)
+
+	if err := checkQueue(*queue); err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("queue", *queue)
+	v.Set("msg_id", fmt.Sprintf("%d", *id))
+
+	_, err := httpDo("POST", fmt.Sprintf("/msg/%s?%s", action, v.Encode()))
+	return err
+}
+
+func runAck(args []string) error {
+	return leaseRequest("ack", args)
+}
+
+func runNack(args []string) error {
+	return leaseRequest("nack", args)
+}
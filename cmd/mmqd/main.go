@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/moonmq/broker"
-	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var configFile = flag.String("config", "", "config file")
+var shutdownTimeout = flag.Int("shutdown_timeout", 30, "seconds to wait msgs acked when shutting down")
 
 func main() {
 	flag.Parse()
@@ -15,16 +21,39 @@ func main() {
 		panic("config file must set")
 	}
 
-	buf, err := ioutil.ReadFile(*configFile)
-	if err != nil {
-		panic(err)
-	}
-
 	var app *broker.App
-	app, err = broker.NewApp(buf)
+	var err error
+	app, err = broker.NewAppWithConfigFile(*configFile)
 	if err != nil {
 		panic(err)
 	}
 
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		var sig os.Signal
+		for sig = range sc {
+			if sig != syscall.SIGHUP {
+				break
+			}
+
+			if _, err := app.ReloadFile(); err != nil {
+				log.Infof("reload config error %v", err)
+			}
+		}
+
+		log.Infof("receive signal %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+		app.Shutdown(ctx)
+		cancel()
+
+		close(done)
+	}()
+
 	app.Run()
+
+	<-done
 }
@@ -0,0 +1,179 @@
+/*
+Package mmqtest starts an in-process broker with mem store on ephemeral
+ports for tests, with a ready client and helpers to check queues.
+
+	b := mmqtest.NewBroker(t)
+	b.Publish("queue", "", []byte("hello"))
+	b.AssertQueueBodies("queue", "hello")
+
+broker and client are closed when test finishes.
+*/
+package mmqtest
+
+import (
+	"fmt"
+	"github.com/siddontang/moonmq/broker"
+	"github.com/siddontang/moonmq/client"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Broker struct {
+	App    *broker.App
+	Client *client.Client
+
+	tb testing.TB
+}
+
+// NewBroker starts broker, options can change broker config before start,
+// address and store are set to ephemeral ports and mem already
+func NewBroker(tb testing.TB, options ...func(cfg *broker.Config)) *Broker {
+	tb.Helper()
+
+	cfg := broker.NewDefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HttpAddr = "127.0.0.1:0"
+	cfg.KeepAlive = 60
+	cfg.Store = "mem"
+	cfg.StoreConfig = nil
+
+	for _, option := range options {
+		option(cfg)
+	}
+
+	app, err := broker.NewAppWithConfig(cfg)
+	if err != nil {
+		tb.Fatalf("start broker error: %s", err.Error())
+	}
+
+	//listeners are ready, conns wait in backlog until Run accepts
+	go app.Run()
+
+	ccfg := client.NewDefaultConfig()
+	ccfg.BrokerAddr = app.Addr()
+
+	c, err := client.NewClientWithConfig(ccfg)
+	if err != nil {
+		app.Close()
+		tb.Fatalf("create client error: %s", err.Error())
+	}
+
+	b := &Broker{app, c, tb}
+
+	tb.Cleanup(b.Close)
+
+	return b
+}
+
+// Addr returns broker tcp address
+func (b *Broker) Addr() string {
+	return b.App.Addr()
+}
+
+// HttpUrl returns url of broker http api path, e.g, /msg
+func (b *Broker) HttpUrl(path string) string {
+	return fmt.Sprintf("http://%s%s", b.App.HttpAddr(), path)
+}
+
+// NewClient creates another client of broker, closed when test finishes
+func (b *Broker) NewClient(options ...func(cfg *client.Config)) *client.Client {
+	b.tb.Helper()
+
+	cfg := client.NewDefaultConfig()
+	cfg.BrokerAddr = b.App.Addr()
+
+	for _, option := range options {
+		option(cfg)
+	}
+
+	c, err := client.NewClientWithConfig(cfg)
+	if err != nil {
+		b.tb.Fatalf("create client error: %s", err.Error())
+	}
+
+	b.tb.Cleanup(c.Close)
+
+	return c
+}
+
+func (b *Broker) Close() {
+	b.Client.Close()
+	b.App.Close()
+}
+
+// Publish publishes a direct msg and returns msg id, it fails test on error
+func (b *Broker) Publish(queue string, routingKey string, body []byte) int64 {
+	b.tb.Helper()
+
+	id, err := b.Client.PublishDirect(queue, routingKey, body)
+	if err != nil {
+		b.tb.Fatalf("publish to %s error: %s", queue, err.Error())
+	}
+
+	return id
+}
+
+// QueueLen returns msgs stored in queue, including the one waiting ack
+func (b *Broker) QueueLen(queue string) int {
+	b.tb.Helper()
+
+	n, err := b.App.QueueLen(queue)
+	if err != nil {
+		b.tb.Fatalf("queue %s len error: %s", queue, err.Error())
+	}
+
+	return n
+}
+
+// QueueMsgs returns all msgs stored in queue
+func (b *Broker) QueueMsgs(queue string) []*broker.QueueMsg {
+	b.tb.Helper()
+
+	ms, err := b.App.PeekQueue(queue, b.QueueLen(queue))
+	if err != nil {
+		b.tb.Fatalf("peek queue %s error: %s", queue, err.Error())
+	}
+
+	return ms
+}
+
+func (b *Broker) AssertQueueLen(queue string, n int) {
+	b.tb.Helper()
+
+	if m := b.QueueLen(queue); m != n {
+		b.tb.Fatalf("queue %s has %d msgs, expect %d", queue, m, n)
+	}
+}
+
+// AssertQueueBodies checks bodies of all msgs stored in queue in order
+func (b *Broker) AssertQueueBodies(queue string, bodies ...string) {
+	b.tb.Helper()
+
+	got := make([]string, 0, len(bodies))
+	for _, m := range b.QueueMsgs(queue) {
+		got = append(got, string(m.Body))
+	}
+
+	if !reflect.DeepEqual(got, bodies) && !(len(got) == 0 && len(bodies) == 0) {
+		b.tb.Fatalf("queue %s has msgs %q, expect %q", queue, got, bodies)
+	}
+}
+
+// WaitQueueLen waits queue having n msgs, pushes and acks are async so
+// queue len changes a bit later
+func (b *Broker) WaitQueueLen(queue string, n int, timeout time.Duration) {
+	b.tb.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		m := b.QueueLen(queue)
+		if m == n {
+			return
+		} else if time.Now().After(deadline) {
+			b.tb.Fatalf("queue %s has %d msgs after %v, expect %d", queue, m, timeout, n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
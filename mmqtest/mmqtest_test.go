@@ -0,0 +1,48 @@
+package mmqtest
+
+import (
+	"github.com/siddontang/moonmq/client"
+	"testing"
+	"time"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(t)
+
+	queue := "test_queue"
+
+	b.AssertQueueBodies(queue)
+
+	b.Publish(queue, "", []byte("1"))
+	b.Publish(queue, "", []byte("2"))
+
+	b.AssertQueueLen(queue, 2)
+	b.AssertQueueBodies(queue, "1", "2")
+
+	c, err := b.Client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cs, err := c.Consume(queue, "", func(d *client.Delivery) error {
+		return nil
+	}, &client.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	b.WaitQueueLen(queue, 0, 2*time.Second)
+}
+
+func TestBrokers(t *testing.T) {
+	//brokers don't share ports or store
+	b1 := NewBroker(t)
+	b2 := NewBroker(t)
+
+	b1.Publish("test_queue", "", []byte("1"))
+
+	b1.AssertQueueLen("test_queue", 1)
+	b2.AssertQueueLen("test_queue", 0)
+}
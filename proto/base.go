@@ -14,3 +14,43 @@ func NewHeartbeatProto() *HeartbeatProto {
 
 	return &p
 }
+
+// Method: Flow
+// Fields:
+//     //broker asks publisher to pause(0) or resume(1) publishing
+//     active: 1 or 0
+// Body: nil
+type FlowProto struct {
+	P *Proto
+}
+
+func NewFlowProto(active bool) *FlowProto {
+	var p FlowProto
+
+	p.P = NewProto(Flow, nil, nil)
+
+	if active {
+		p.P.Fields[ActiveStr] = "1"
+	} else {
+		p.P.Fields[ActiveStr] = "0"
+	}
+
+	return &p
+}
+
+// Method: Shutdown
+// Fields: nil
+// Body: nil
+// broker is shutting down, client should stop consuming and publishing,
+// msgs already pushed can still be acked until broker closes the conn
+type ShutdownProto struct {
+	P *Proto
+}
+
+func NewShutdownProto() *ShutdownProto {
+	var p ShutdownProto
+
+	p.P = NewProto(Shutdown, nil, nil)
+
+	return &p
+}
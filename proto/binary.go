@@ -0,0 +1,180 @@
+package proto
+
+import (
+	"encoding/binary"
+)
+
+/*
+   Binary header format is
+
+   |magic(1 byte, 0)|flags(1 byte)|method(uvarint)|field count(uvarint)|fields|
+
+   every field is
+
+   |key id(1 byte)|[key length(uvarint)|key, only if key id is 0]|value length(uvarint)|value|
+
+   well known keys use a non-zero key id, others are written with key id 0.
+   json header always begins with '{', so the magic tells them apart.
+*/
+
+const binaryHeaderMagic byte = 0
+
+//append only, never change an existing id
+var binaryFieldKeys = []string{
+	"",
+	MsgIdStr,
+	VersionStr,
+	PubTypeStr,
+	QueueStr,
+	RoutingKeyStr,
+	NoAckStr,
+	CodeStr,
+	ActiveStr,
+	ReqIdStr,
+	HeaderEncodingStr,
+	CompressionStr,
+	TimeoutStr,
+	CountStr,
+	HeadersStr,
+	RequeueStr,
+}
+
+var binaryFieldIds map[string]byte
+
+func init() {
+	binaryFieldIds = make(map[string]byte, len(binaryFieldKeys))
+	for i, key := range binaryFieldKeys {
+		if i > 0 {
+			binaryFieldIds[key] = byte(i)
+		}
+	}
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendBinaryString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func marshalBinaryHeader(p *Proto) []byte {
+	buf := make([]byte, 0, 16+len(p.Fields)*16)
+
+	buf = append(buf, binaryHeaderMagic, p.Flags)
+	buf = appendUvarint(buf, uint64(p.Method))
+	buf = appendUvarint(buf, uint64(len(p.Fields)))
+
+	for key, value := range p.Fields {
+		if id, ok := binaryFieldIds[key]; ok {
+			buf = append(buf, id)
+		} else {
+			buf = append(buf, 0)
+			buf = appendBinaryString(buf, key)
+		}
+
+		buf = appendBinaryString(buf, value)
+	}
+
+	return buf
+}
+
+type binaryReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *binaryReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, ErrBufShort
+	}
+
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *binaryReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, ErrInvalidBuf
+	}
+
+	r.pos += n
+	return v, nil
+}
+
+func (r *binaryReader) string() (string, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+
+	if uint64(len(r.buf)-r.pos) < n {
+		return "", ErrBufShort
+	}
+
+	s := string(r.buf[r.pos : r.pos+int(n)])
+	r.pos += int(n)
+	return s, nil
+}
+
+func unmarshalBinaryHeader(buf []byte, p *Proto) error {
+	r := &binaryReader{buf: buf}
+
+	if magic, err := r.byte(); err != nil {
+		return err
+	} else if magic != binaryHeaderMagic {
+		return ErrInvalidBuf
+	}
+
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	p.Flags = flags
+
+	method, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	p.Method = uint32(method)
+
+	n, err := r.uvarint()
+	if err != nil {
+		return err
+	} else if n > uint64(len(buf)) {
+		return ErrInvalidBuf
+	}
+
+	p.Fields = make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		var key string
+		id, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		if id == 0 {
+			if key, err = r.string(); err != nil {
+				return err
+			}
+		} else if int(id) < len(binaryFieldKeys) {
+			key = binaryFieldKeys[id]
+		} else {
+			return ErrInvalidBuf
+		}
+
+		value, err := r.string()
+		if err != nil {
+			return err
+		}
+
+		p.Fields[key] = value
+	}
+
+	return nil
+}
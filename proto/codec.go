@@ -3,23 +3,58 @@ package proto
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
 type Encoder struct {
 	w io.Writer
+
+	encoding string
+
+	compressor Compressor
+	threshold  int
 }
 
 func NewEncoder(w io.Writer) *Encoder {
 	e := new(Encoder)
 
 	e.w = w
+	e.encoding = JsonEncoding
 
 	return e
 }
 
+//SetHeaderEncoding changes header encoding for later encoded protos,
+//not thread safe
+func (e *Encoder) SetHeaderEncoding(encoding string) {
+	e.encoding = encoding
+}
+
+//SetCompressor compresses body not less than threshold for later encoded
+//protos, nil compressor disables compression, not thread safe
+func (e *Encoder) SetCompressor(c Compressor, threshold int) {
+	e.compressor = c
+	e.threshold = threshold
+}
+
 func (e *Encoder) Encode(p *Proto) error {
-	if buf, err := Marshal(p); err != nil {
+	if e.compressor != nil && len(p.Body) >= e.threshold && len(p.Body) > 0 {
+		body, err := e.compressor.Compress(p.Body)
+		if err != nil {
+			return err
+		}
+
+		if len(body) < len(p.Body) {
+			//don't change caller's proto
+			cp := *p
+			cp.Flags |= FlagCompressed
+			cp.Body = body
+			p = &cp
+		}
+	}
+
+	if buf, err := MarshalEncoding(p, e.encoding); err != nil {
 		return err
 	} else {
 		_, err = e.w.Write(buf)
@@ -29,6 +64,9 @@ func (e *Encoder) Encode(p *Proto) error {
 
 type Decoder struct {
 	r *bufio.Reader
+
+	compressor Compressor
+	maxBody    int
 }
 
 const defaultReaderSize = 128
@@ -59,9 +97,36 @@ func (d *Decoder) Decode() (*Proto, error) {
 		return nil, err
 	}
 
-	err = Unmarshal(buf, p)
+	if err = Unmarshal(buf, p); err != nil {
+		return p, err
+	}
+
+	if p.Flags&FlagCompressed != 0 {
+		if d.compressor == nil {
+			return p, fmt.Errorf("compressed proto without negotiated compressor")
+		}
+
+		if p.Body, err = d.compressor.Decompress(p.Body, d.maxBody); err != nil {
+			return p, err
+		}
+
+		p.Flags &^= FlagCompressed
+	}
+
+	return p, nil
+}
+
+//SetCompressor sets compressor for compressed protos decoded later,
+//not thread safe
+func (d *Decoder) SetCompressor(c Compressor) {
+	d.compressor = c
+}
 
-	return p, err
+//SetMaxBodySize rejects compressed protos whose body decompresses larger
+//than n with ErrBodyTooLarge, the proto is still returned without body,
+//so caller can reply it and go on decoding, 0 means no limit, not thread safe
+func (d *Decoder) SetMaxBodySize(n int) {
+	d.maxBody = n
 }
 
 type Coder struct {
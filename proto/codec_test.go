@@ -32,3 +32,88 @@ func TestCodec(t *testing.T) {
 		t.Fatal("error")
 	}
 }
+
+func TestCodecCompress(t *testing.T) {
+	c := GetCompressor(SnappyCompression)
+
+	body := bytes.Repeat([]byte("hello world"), 200)
+	p := NewProto(Push, map[string]string{QueueStr: "abc"}, body)
+
+	wb := bytes.NewBuffer(nil)
+	e := NewEncoder(wb)
+	e.SetHeaderEncoding(BinaryEncoding)
+	e.SetCompressor(c, DefaultCompressThreshold)
+
+	if err := e.Encode(p); err != nil {
+		t.Fatal(err)
+	} else if wb.Len() >= len(body) {
+		t.Fatal("not compressed")
+	}
+
+	d := NewDecoder(bytes.NewBuffer(wb.Bytes()))
+	if _, err := d.Decode(); err == nil {
+		t.Fatal("must error without compressor")
+	}
+
+	d = NewDecoder(bytes.NewBuffer(wb.Bytes()))
+	d.SetCompressor(c)
+
+	p2, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal("error")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 1024*1024)
+
+	for _, name := range []string{GzipCompression, SnappyCompression, ZstdCompression} {
+		c := GetCompressor(name)
+
+		buf, err := c.Compress(body)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if _, err = c.Decompress(buf, len(body)-1); err != ErrBodyTooLarge {
+			t.Fatal(name, err)
+		}
+
+		if b, err := c.Decompress(buf, len(body)); err != nil || !bytes.Equal(b, body) {
+			t.Fatal(name, err)
+		}
+
+		if b, err := c.Decompress(buf, 0); err != nil || !bytes.Equal(b, body) {
+			t.Fatal(name, err)
+		}
+	}
+
+	//decoder rejects body and goes on decoding next proto
+	c := GetCompressor(GzipCompression)
+
+	wb := bytes.NewBuffer(nil)
+	e := NewEncoder(wb)
+	e.SetCompressor(c, DefaultCompressThreshold)
+
+	if err := e.Encode(NewProto(Publish, map[string]string{QueueStr: "abc"}, body)); err != nil {
+		t.Fatal(err)
+	} else if err = e.Encode(NewProto(Publish, map[string]string{QueueStr: "abc"}, body[:1024])); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(wb)
+	d.SetCompressor(c)
+	d.SetMaxBodySize(1024)
+
+	if p, err := d.Decode(); err != ErrBodyTooLarge || p.Queue() != "abc" || p.Body != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := d.Decode(); err != nil || !bytes.Equal(p.Body, body[:1024]) {
+		t.Fatal(err)
+	}
+}
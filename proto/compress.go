@@ -0,0 +1,201 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+)
+
+//ErrBodyTooLarge is returned if decompressed data exceeds the max size
+var ErrBodyTooLarge = fmt.Errorf("body too large")
+
+//Compressor compresses proto body on the wire and msg body at rest
+type Compressor interface {
+	Name() string
+
+	//non-zero id less than 16, saved with compressed data, never change it
+	ID() uint8
+
+	Compress(src []byte) ([]byte, error)
+
+	//return ErrBodyTooLarge as soon as decompressed data exceeds max,
+	//0 means no limit
+	Decompress(src []byte, max int) ([]byte, error)
+}
+
+const (
+	GzipCompression   = "gzip"
+	SnappyCompression = "snappy"
+	ZstdCompression   = "zstd"
+)
+
+var compressors = map[string]Compressor{}
+var compressorIds = map[uint8]Compressor{}
+
+func RegisterCompressor(c Compressor) error {
+	if c.ID() == 0 || c.ID() > 15 {
+		return fmt.Errorf("invalid compressor id %d", c.ID())
+	}
+
+	if _, ok := compressors[c.Name()]; ok {
+		return fmt.Errorf("%s has been registered", c.Name())
+	} else if _, ok := compressorIds[c.ID()]; ok {
+		return fmt.Errorf("compressor id %d has been registered", c.ID())
+	}
+
+	compressors[c.Name()] = c
+	compressorIds[c.ID()] = c
+	return nil
+}
+
+//return nil if not registered
+func GetCompressor(name string) Compressor {
+	return compressors[name]
+}
+
+func GetCompressorByID(id uint8) Compressor {
+	return compressorIds[id]
+}
+
+type gzipCompressor struct {
+}
+
+func (c gzipCompressor) Name() string {
+	return GzipCompression
+}
+
+func (c gzipCompressor) ID() uint8 {
+	return 1
+}
+
+func (c gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c gzipCompressor) Decompress(src []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	} else if len(buf) > max {
+		return nil, ErrBodyTooLarge
+	}
+
+	return buf, nil
+}
+
+type snappyCompressor struct {
+}
+
+func (c snappyCompressor) Name() string {
+	return SnappyCompression
+}
+
+func (c snappyCompressor) ID() uint8 {
+	return 2
+}
+
+func (c snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (c snappyCompressor) Decompress(src []byte, max int) ([]byte, error) {
+	if max > 0 {
+		//snappy block saves decoded length ahead
+		if n, err := snappy.DecodedLen(src); err != nil {
+			return nil, err
+		} else if n > max {
+			return nil, ErrBodyTooLarge
+		}
+	}
+
+	return snappy.Decode(nil, src)
+}
+
+//zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll,
+//ld decodes at most cap of dst for limited decompression
+type zstdCompressor struct {
+	e  *zstd.Encoder
+	d  *zstd.Decoder
+	ld *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	c := new(zstdCompressor)
+
+	c.e, _ = zstd.NewWriter(nil)
+	c.d, _ = zstd.NewReader(nil)
+	c.ld, _ = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+
+	return c
+}
+
+func (c *zstdCompressor) Name() string {
+	return ZstdCompression
+}
+
+func (c *zstdCompressor) ID() uint8 {
+	return 3
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return c.e.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte, max int) ([]byte, error) {
+	if max <= 0 {
+		return c.d.DecodeAll(src, nil)
+	}
+
+	//don't allocate max if frame tells a smaller size
+	size := max
+	var h zstd.Header
+	if err := h.Decode(src); err == nil && h.HasFCS {
+		if h.FrameContentSize > uint64(max) {
+			return nil, ErrBodyTooLarge
+		}
+		size = int(h.FrameContentSize)
+	}
+
+	buf, err := c.ld.DecodeAll(src, make([]byte, 0, size))
+	if err == zstd.ErrDecoderSizeExceeded && size < max {
+		//more frames follow the first one
+		buf, err = c.ld.DecodeAll(src, make([]byte, 0, max))
+	}
+
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, ErrBodyTooLarge
+	}
+	return buf, err
+}
+
+func init() {
+	RegisterCompressor(gzipCompressor{})
+	RegisterCompressor(snappyCompressor{})
+	RegisterCompressor(newZstdCompressor())
+}
@@ -12,6 +12,10 @@ package proto
 
 // asynchronous is even number
 
+// every request may supply a req_id field, broker echoes it in the
+// synchronous reply or error for that request, so replies can be
+// dispatched by req_id instead of by order
+
 const (
 	Publish    uint32 = 10
 	Publish_OK uint32 = 11
@@ -22,11 +26,21 @@ const (
 	Unbind    uint32 = 30
 	Unbind_OK uint32 = 31
 
+	Handshake    uint32 = 40
+	Handshake_OK uint32 = 41
+
+	Get       uint32 = 50
+	Get_OK    uint32 = 51
+	Get_Empty uint32 = 53
+
 	//asynchronous > 10000
 	Error     uint32 = 10010
 	Heartbeat uint32 = 10020
 	Push      uint32 = 10030
 	Ack       uint32 = 10040
+	Flow      uint32 = 10050
+	Shutdown  uint32 = 10060
+	Nack      uint32 = 10070
 )
 
 const (
@@ -37,6 +51,23 @@ const (
 	RoutingKeyStr = "routing_key"
 	NoAckStr      = "no_ack"
 	CodeStr       = "code"
+	ActiveStr     = "active"
+	ReqIdStr      = "req_id"
+
+	HeaderEncodingStr = "header_encoding"
+	CompressionStr    = "compression"
+	TimeoutStr        = "timeout"
+	CountStr          = "count"
+	HeadersStr        = "headers"
+	RequeueStr        = "requeue"
+)
+
+//current protocol version
+const Version uint32 = 1
+
+const (
+	JsonEncoding   = "json"
+	BinaryEncoding = "binary"
 )
 
 const (
@@ -57,4 +88,8 @@ var PublishTypeMap = map[string]uint8{
 const (
 	MaxQueueName      = 200
 	MaxRoutingKeyName = 200
+	MaxGetCount       = 1000
 )
+
+//body less than it is not compressed
+const DefaultCompressThreshold = 1024
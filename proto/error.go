@@ -7,6 +7,7 @@ import (
 // Method: Error
 // Fields:
 //     code: xxx (http error code, int string)
+//     req_id: xxx (if supplied in request)
 // Body: message
 type ProtoError struct {
 	P *Proto
@@ -0,0 +1,121 @@
+package proto
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// Method: Get
+// Fields:
+//     queue: xxx
+//     routing_key: xxx
+//     no_ack: 1 or none
+//     //max wait milliseconds if queue is empty, 0 for no wait
+//     timeout: xxx
+//     //max msgs, only 1 if not no_ack
+//     count: xxx
+// Body: nil
+type GetProto struct {
+	P *Proto
+}
+
+func NewGetProto(queue string, routingKey string, noAck bool, timeout time.Duration, count int) *GetProto {
+	var p GetProto
+
+	p.P = NewProto(Get, map[string]string{
+		QueueStr:      queue,
+		RoutingKeyStr: routingKey,
+		TimeoutStr:    strconv.FormatInt(int64(timeout/time.Millisecond), 10),
+		CountStr:      strconv.Itoa(count),
+	}, nil)
+
+	if noAck {
+		p.P.Fields[NoAckStr] = "1"
+	}
+
+	return &p
+}
+
+// Method: Get_OK
+// Fields:
+//     queue: xxx
+// Body:
+//     msgs, every msg is |msg id(8 bytes)|body length(4 bytes)|body|
+//     if not no_ack, msg must be acked using Ack
+type GetOKProto struct {
+	P *Proto
+}
+
+type GetMsg struct {
+	MsgId int64
+	Body  []byte
+}
+
+func NewGetOKProto(queue string, msgs []*GetMsg) *GetOKProto {
+	var p GetOKProto
+
+	n := 0
+	for _, m := range msgs {
+		n += 12 + len(m.Body)
+	}
+
+	body := make([]byte, 0, n)
+	for _, m := range msgs {
+		var b [12]byte
+		binary.BigEndian.PutUint64(b[0:8], uint64(m.MsgId))
+		binary.BigEndian.PutUint32(b[8:12], uint32(len(m.Body)))
+
+		body = append(body, b[:]...)
+		body = append(body, m.Body...)
+	}
+
+	p.P = NewProto(Get_OK, map[string]string{
+		QueueStr: queue,
+	}, body)
+
+	return &p
+}
+
+func DecodeGetMsgs(body []byte) ([]*GetMsg, error) {
+	msgs := []*GetMsg{}
+	for len(body) > 0 {
+		if len(body) < 12 {
+			return nil, ErrBufShort
+		}
+
+		m := new(GetMsg)
+		m.MsgId = int64(binary.BigEndian.Uint64(body[0:8]))
+		n := binary.BigEndian.Uint32(body[8:12])
+		body = body[12:]
+
+		if uint32(len(body)) < n {
+			return nil, ErrBufShort
+		}
+
+		m.Body = body[:n]
+		body = body[n:]
+
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+// Method: Get_Empty
+// Fields:
+//     queue: xxx
+// Body: nil
+type GetEmptyProto struct {
+	P *Proto
+}
+
+func NewGetEmptyProto(queue string) *GetEmptyProto {
+	var p GetEmptyProto
+
+	p.P = NewProto(Get_Empty, map[string]string{
+		QueueStr: queue,
+	}, nil)
+
+	return &p
+}
@@ -0,0 +1,94 @@
+package proto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Method: Handshake
+// Fields:
+//     version: xxx (protocol version client speaks)
+//     //header encodings client supports, preferred first
+//     header_encoding: binary,json
+//     //optional body compressions client supports, preferred first
+//     compression: zstd,snappy,gzip
+// Body: nil
+//
+// Handshake is optional and should be the first request, its header is
+// always json. A client not sending it uses json header.
+type HandshakeProto struct {
+	P *Proto
+}
+
+func NewHandshakeProto(version uint32, encodings []string, compressions []string) *HandshakeProto {
+	var p HandshakeProto
+
+	p.P = NewProto(Handshake, map[string]string{
+		VersionStr:        strconv.FormatUint(uint64(version), 10),
+		HeaderEncodingStr: strings.Join(encodings, ","),
+	}, nil)
+
+	if len(compressions) > 0 {
+		p.P.Fields[CompressionStr] = strings.Join(compressions, ",")
+	}
+
+	return &p
+}
+
+// Method: Handshake_OK
+// Fields:
+//     version: xxx (negotiated)
+//     header_encoding: xxx (negotiated, used after this reply)
+//     //negotiated, none if empty, bodies may be compressed after this reply
+//     //and such protos have FlagCompressed set
+//     compression: xxx
+// Body: nil
+type HandshakeOKProto struct {
+	P *Proto
+}
+
+func NewHandshakeOKProto(version uint32, encoding string, compression string) *HandshakeOKProto {
+	var p HandshakeOKProto
+
+	p.P = NewProto(Handshake_OK, map[string]string{
+		VersionStr:        strconv.FormatUint(uint64(version), 10),
+		HeaderEncodingStr: encoding,
+	}, nil)
+
+	if len(compression) > 0 {
+		p.P.Fields[CompressionStr] = compression
+	}
+
+	return &p
+}
+
+func (p *Proto) Version() (uint32, error) {
+	v, err := strconv.ParseUint(p.Value(VersionStr), 10, 32)
+	return uint32(v), err
+}
+
+func (p *Proto) HeaderEncodings() []string {
+	return splitList(p.Value(HeaderEncodingStr))
+}
+
+func (p *Proto) Compressions() []string {
+	return splitList(p.Value(CompressionStr))
+}
+
+func splitList(v string) []string {
+	vs := strings.Split(v, ",")
+
+	list := make([]string, 0, len(vs))
+	for _, v := range vs {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+func ValidHeaderEncoding(encoding string) bool {
+	return encoding == JsonEncoding || encoding == BinaryEncoding
+}
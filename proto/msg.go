@@ -8,6 +8,10 @@ package proto
 //     //direct select a consumer to push using round-robin
 //     //fanout broadcast to all consumers, ignore routing key
 //     pub_type: xxx
+//     //optional, echoed in Publish_OK or Error, so publishes can be pipelined
+//     req_id: xxx
+//     //optional, json object of string values, see SetHeaders
+//     headers: xxx
 // Body:
 //     body
 type PublishProto struct {
@@ -27,7 +31,8 @@ func NewPublishProto(queue string, routingKey string, pubType string, body []byt
 }
 
 // Method: Publish_OK
-// Fields: nil
+// Fields:
+//     req_id: xxx (if supplied in Publish)
 // Body: msg id (int64 string)
 type PublishOKProto struct {
 	P *Proto
@@ -45,6 +50,7 @@ func NewPublishOKProto(msgId string) *PublishOKProto {
 // Fields:
 //     queue: xxx
 //     msg_id: xxx
+//     headers: xxx (if msg has headers)
 // Body:
 //     body
 type PushProto struct {
@@ -80,3 +86,30 @@ func NewAckProto(queue string, msgId string) *AckProto {
 
 	return &p
 }
+
+// Method: Nack
+// Fields:
+//     queue: xxx
+//     msg_id: xxx (int64 string)
+//     //"1" push msg again, to another consumer if possible, otherwise discard it
+//     requeue: 1|0
+type NackProto struct {
+	P *Proto
+}
+
+func NewNackProto(queue string, msgId string, requeue bool) *NackProto {
+	var p NackProto
+
+	var r string = "0"
+	if requeue {
+		r = "1"
+	}
+
+	p.P = NewProto(Nack, map[string]string{
+		QueueStr:   queue,
+		MsgIdStr:   msgId,
+		RequeueStr: r,
+	}, nil)
+
+	return &p
+}
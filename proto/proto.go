@@ -14,15 +14,26 @@ var (
 /*
    Proto binary format is
 
-   |total length(4 bytes)|header length(4 bytes)|header json|body|
+   |total length(4 bytes)|header length(4 bytes)|header|body|
 
-   total length = 4 + len(header json) + len(body)
-   header length = len(header json)
+   total length = 4 + len(header) + len(body)
+   header length = len(header)
+
+   header is json by default, or binary (see binary.go) if negotiated
+   in handshake, unmarshal detects the header encoding itself.
 */
 
+//proto flags
+const (
+	//body is compressed with the codec negotiated in handshake
+	FlagCompressed uint8 = 1 << 0
+)
+
 type Proto struct {
 	Method uint32 `json:"method"`
 
+	Flags uint8 `json:"flags,omitempty"`
+
 	Fields map[string]string `json:"fields"`
 
 	Body []byte `json:"-"`
@@ -67,12 +78,58 @@ func (p *Proto) MsgId() string {
 	return p.Value(MsgIdStr)
 }
 
-func Marshal(p *Proto) ([]byte, error) {
-	header, err := json.Marshal(p)
+func (p *Proto) ReqId() string {
+	return p.Value(ReqIdStr)
+}
+
+//SetHeaders sets msg headers as a json field, empty headers are omitted
+func (p *Proto) SetHeaders(headers map[string]string) error {
+	if len(headers) == 0 {
+		delete(p.Fields, HeadersStr)
+		return nil
+	}
+
+	buf, err := json.Marshal(headers)
 	if err != nil {
+		return err
+	}
+
+	p.Fields[HeadersStr] = string(buf)
+	return nil
+}
+
+//Headers returns msg headers, nil if not supplied
+func (p *Proto) Headers() (map[string]string, error) {
+	v := p.Value(HeadersStr)
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(v), &headers); err != nil {
 		return nil, err
 	}
 
+	return headers, nil
+}
+
+func Marshal(p *Proto) ([]byte, error) {
+	return MarshalEncoding(p, JsonEncoding)
+}
+
+func MarshalEncoding(p *Proto, encoding string) ([]byte, error) {
+	var header []byte
+	var err error
+
+	if encoding == BinaryEncoding {
+		header = marshalBinaryHeader(p)
+	} else {
+		header, err = json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	length := 4 + len(header) + len(p.Body)
 	buf := make([]byte, 8, length)
 
@@ -101,7 +158,12 @@ func Unmarshal(buf []byte, p *Proto) error {
 		return ErrInvalidBuf
 	}
 
-	if err := json.Unmarshal(buf[8:8+headerLen], p); err != nil {
+	header := buf[8 : 8+headerLen]
+	if len(header) > 0 && header[0] == binaryHeaderMagic {
+		if err := unmarshalBinaryHeader(header, p); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(header, p); err != nil {
 		return err
 	}
 
@@ -32,3 +32,63 @@ func TestProto(t *testing.T) {
 		t.Fatal("not equal")
 	}
 }
+
+func TestBinaryProto(t *testing.T) {
+	p := NewProto(Publish, map[string]string{
+		QueueStr:      "abc",
+		RoutingKeyStr: "",
+		"key1":        "value1",
+	}, []byte("hello world"))
+
+	buf, err := MarshalEncoding(p, BinaryEncoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := new(Proto)
+
+	err = Unmarshal(buf, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal("not equal")
+	}
+
+	if err = Unmarshal(buf[:len(buf)-len(p.Body)-1], p2); err == nil {
+		t.Fatal("must error")
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tc, err := ParseTraceparent(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if tc.String() != s || tc.Flags != TraceFlagSampled {
+		t.Fatal(tc.String())
+	}
+
+	if c := tc.NewChild(); c.TraceID != tc.TraceID || c.SpanID == tc.SpanID {
+		t.Fatal(c.String())
+	}
+
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xx",
+	} {
+		if _, err = ParseTraceparent(v); err == nil {
+			t.Fatal("must fail", v)
+		}
+	}
+
+	if _, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xx"); err != nil {
+		t.Fatal(err)
+	}
+}
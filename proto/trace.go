@@ -0,0 +1,113 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+/*
+   W3C trace context is carried in msg header traceparent
+
+   version(2 hex)-trace id(32 hex)-parent span id(16 hex)-flags(2 hex)
+
+   e.g, 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+*/
+
+const TraceparentHeader = "traceparent"
+
+//TraceFlagSampled is set if caller may record the trace
+const TraceFlagSampled uint8 = 1
+
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   uint8
+}
+
+//Valid returns false if trace id or span id is all zero
+func (tc TraceContext) Valid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+//String returns traceparent value
+func (tc TraceContext) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(tc.TraceID[:]),
+		hex.EncodeToString(tc.SpanID[:]), tc.Flags)
+}
+
+//NewChild returns context of a new span in the same trace
+func (tc TraceContext) NewChild() TraceContext {
+	c := tc
+	rand.Read(c.SpanID[:])
+	return c
+}
+
+//NewTraceContext starts a new sampled trace
+func NewTraceContext() TraceContext {
+	var tc TraceContext
+	rand.Read(tc.TraceID[:])
+	rand.Read(tc.SpanID[:])
+	tc.Flags = TraceFlagSampled
+	return tc
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid hex %s", s)
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+//ParseTraceparent parses traceparent value, future versions are accepted
+//if they begin with version 00 fields
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return tc, fmt.Errorf("invalid traceparent %s", s)
+	}
+
+	var version [1]byte
+	if err := decodeHex(version[:], parts[0]); err != nil || version[0] == 0xff {
+		return tc, fmt.Errorf("invalid traceparent version %s", parts[0])
+	} else if version[0] == 0 && len(parts) != 4 {
+		return tc, fmt.Errorf("invalid traceparent %s", s)
+	}
+
+	var flags [1]byte
+	if err := decodeHex(tc.TraceID[:], parts[1]); err != nil {
+		return tc, err
+	} else if err = decodeHex(tc.SpanID[:], parts[2]); err != nil {
+		return tc, err
+	} else if err = decodeHex(flags[:], parts[3]); err != nil {
+		return tc, err
+	}
+
+	tc.Flags = flags[0]
+
+	if !tc.Valid() {
+		return tc, fmt.Errorf("invalid traceparent %s, zero id", s)
+	}
+
+	return tc, nil
+}
+
+//TraceFromHeaders returns valid trace context in msg headers
+func TraceFromHeaders(headers map[string]string) (TraceContext, bool) {
+	v, ok := headers[TraceparentHeader]
+	if !ok {
+		return TraceContext{}, false
+	}
+
+	tc, err := ParseTraceparent(v)
+	if err != nil {
+		return TraceContext{}, false
+	}
+
+	return tc, true
+}